@@ -10,6 +10,7 @@ import (
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 	"github.com/hashicorp/go-sockaddr"
+	"github.com/hashicorp/go-sockaddr/template"
 )
 
 // HaAddress is a helper struct to define our listening
@@ -19,7 +20,11 @@ type HaAddress struct {
 	Port    uint16
 }
 
-// NewListen create a new HaAddress thanks an "ip:port" string
+// NewListen create a new HaAddress thanks an "ip:port" string, IPv6 addresses
+// are written between brackets when there is a port, i.e. "[::1]:10001".
+// The host can be a go-sockaddr template which resolves to a single address,
+// i.e. `{{ GetPrivateInterfaces | include "network" "10.0.0.0/8" | attr "address" }}:10001`
+// IPv6 addresses with a zone (i.e. the link-local "fe80::1%eth0") are not supported.
 func NewListen(listen string, autoIp ...bool) (*HaAddress, error) {
 	var (
 		ips  []net.IP
@@ -27,8 +32,17 @@ func NewListen(listen string, autoIp ...bool) (*HaAddress, error) {
 		port uint64
 		err  error
 	)
-	if !strings.ContainsAny(listen, ":") {
-		host = listen
+	if strings.Contains(listen, "{{") {
+		if listen, err = resolveListen(listen); err != nil {
+			return nil, err
+		}
+	}
+	if strings.Contains(listen, "%") {
+		return nil, fmt.Errorf("IPv6 zone not supported in %s", listen)
+	}
+	if bare := strings.TrimSuffix(strings.TrimPrefix(listen, "["), "]"); !strings.ContainsAny(listen, ":") || net.ParseIP(bare) != nil {
+		// host only, or an IPv6 address without port
+		host = bare
 		port = 0
 	} else {
 		var strPort string
@@ -61,6 +75,40 @@ func NewListen(listen string, autoIp ...bool) (*HaAddress, error) {
 	return nil, fmt.Errorf("Host %s not valid", host)
 }
 
+// resolveListen replaces the go-sockaddr template of the host of "listen" by its address
+func resolveListen(listen string) (string, error) {
+	end := strings.LastIndex(listen, "}}")
+	if end < 0 {
+		return "", fmt.Errorf("Unterminated template in %s", listen)
+	}
+	end += len("}}")
+	host, err := parseTemplate(listen[:end])
+	if err != nil {
+		return "", err
+	}
+	rest := listen[end:]
+	if rest == "" {
+		return host, nil
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return "", fmt.Errorf("Invalid port %s in %s", rest, listen)
+	}
+	return net.JoinHostPort(host, rest[1:]), nil
+}
+
+// parseTemplate return the single address selected by the go-sockaddr template "tpl"
+func parseTemplate(tpl string) (string, error) {
+	out, err := template.Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+	addrs := strings.Fields(out)
+	if len(addrs) != 1 {
+		return "", fmt.Errorf("Template %s selects %d addresses, expected one", tpl, len(addrs))
+	}
+	return addrs[0], nil
+}
+
 // NewAddress create a new HaAddress with an ip string and a port int
 func NewAddress(addr string, port int) *HaAddress {
 	return &HaAddress{
@@ -76,8 +124,23 @@ func serfMemberToListen(member serf.Member) *HaAddress {
 	}
 }
 
+// resolve return the HaAddress with its go-sockaddr template replaced by the address it selects
+func (hal *HaAddress) resolve() (*HaAddress, error) {
+	if hal == nil || !strings.Contains(hal.Address, "{{") {
+		return hal, nil
+	}
+	addr, err := parseTemplate(hal.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &HaAddress{
+		Address: addr,
+		Port:    hal.Port,
+	}, nil
+}
+
 func (hal *HaAddress) String() string {
-	return fmt.Sprintf("%s:%d", hal.Address, hal.Port)
+	return net.JoinHostPort(hal.Address, strconv.Itoa(int(hal.Port)))
 }
 
 // Md5 return a MD5 hash of the string "Address:Port"
@@ -0,0 +1,121 @@
+package habolt
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestNewListen(t *testing.T) {
+	for _, test := range []struct {
+		listen  string
+		address string
+		port    uint16
+		str     string
+	}{
+		{"127.0.0.1:10001", "127.0.0.1", 10001, "127.0.0.1:10001"},
+		{"127.0.0.1", "127.0.0.1", 0, "127.0.0.1:0"},
+		{":10001", "", 10001, ":10001"},
+		{"[::1]:10001", "::1", 10001, "[::1]:10001"},
+		{"::1", "::1", 0, "[::1]:0"},
+		{"[::1]", "::1", 0, "[::1]:0"},
+		{"[2001:db8::1]:7946", "2001:db8::1", 7946, "[2001:db8::1]:7946"},
+		{"2001:db8::1", "2001:db8::1", 0, "[2001:db8::1]:0"},
+		{"[::ffff:10.0.0.1]:10001", "10.0.0.1", 10001, "10.0.0.1:10001"},
+	} {
+		addr, err := NewListen(test.listen)
+		if err != nil {
+			t.Errorf("NewListen(%q) failed: %v", test.listen, err)
+			continue
+		}
+		if addr.Address != test.address || addr.Port != test.port {
+			t.Errorf("NewListen(%q) = %q %d, expected %q %d", test.listen, addr.Address, addr.Port, test.address, test.port)
+		}
+		if str := addr.String(); str != test.str {
+			t.Errorf("NewListen(%q).String() = %q, expected %q", test.listen, str, test.str)
+		}
+	}
+}
+
+func TestNewListenInvalid(t *testing.T) {
+	for _, listen := range []string{
+		"127.0.0.1:port",
+		"127.0.0.1:70000",
+		"[::1]:port",
+		"[::1]:70000",
+		"::1:10001x",
+		"fe80::1%eth0",
+		"[fe80::1%eth0]:10001",
+	} {
+		if addr, err := NewListen(listen); err == nil {
+			t.Errorf("NewListen(%q) = %v, expected an error", listen, addr)
+		}
+	}
+}
+
+func TestHaAddressRaft(t *testing.T) {
+	for _, test := range []struct {
+		addr *HaAddress
+		raft string
+	}{
+		{NewAddress("127.0.0.1", 10001), "127.0.0.1:10002"},
+		{NewAddress("::1", 10001), "[::1]:10002"},
+		{NewAddress("2001:db8::1", 7946), "[2001:db8::1]:7947"},
+	} {
+		raft := test.addr.Raft()
+		if raft.String() != test.raft || string(raft.raftAddress()) != test.raft || string(raft.raftID()) != test.raft {
+			t.Errorf("%v.Raft() = %v, expected %s", test.addr, raft, test.raft)
+		}
+		// the string form can be parsed back
+		back, err := NewListen(raft.String())
+		if err != nil || *back != *raft {
+			t.Errorf("NewListen(%q) = %v, %v", raft.String(), back, err)
+		}
+	}
+}
+
+func TestSerfMemberToPeer(t *testing.T) {
+	member := serf.Member{Name: "[2001:db8::1]:7946", Addr: net.ParseIP("2001:db8::1"), Port: 7946}
+	peer := serfMemberToPeer(member)
+	if peer.ID != "[2001:db8::1]:7947" || peer.Address != "[2001:db8::1]:7947" {
+		t.Errorf("legacy peer of %s = %+v", member.Name, peer)
+	}
+
+	member.Tags = map[string]string{serfTagID: "node-1", serfTagRaft: "[2001:db8::2]:8300"}
+	peer = serfMemberToPeer(member)
+	if peer.ID != "node-1" || peer.Address != "[2001:db8::2]:8300" {
+		t.Errorf("peer of %s = %+v", member.Name, peer)
+	}
+
+	member = serf.Member{Name: "10.0.0.1:7946", Addr: net.ParseIP("10.0.0.1"), Port: 7946}
+	if peer = serfMemberToPeer(member); peer.Address != "10.0.0.1:7947" {
+		t.Errorf("legacy peer of %s = %+v", member.Name, peer)
+	}
+}
+
+func TestNewListenTemplate(t *testing.T) {
+	const loopback = `{{ GetAllInterfaces | include "network" "127.0.0.0/8" | join "address" " " }}`
+	addr, err := NewListen(loopback + ":10001")
+	if err != nil || addr.Address != "127.0.0.1" || addr.Port != 10001 {
+		t.Fatalf("NewListen(%q) = %v: %v", loopback+":10001", addr, err)
+	}
+	if addr, err = NewListen(loopback); err != nil || addr.Address != "127.0.0.1" || addr.Port != 0 {
+		t.Fatalf("NewListen(%q) = %v: %v", loopback, addr, err)
+	}
+	if addr, err = NewAddress(loopback, 10001).resolve(); err != nil || addr.String() != "127.0.0.1:10001" {
+		t.Fatalf("resolve of %q = %v: %v", loopback, addr, err)
+	}
+
+	for _, listen := range []string{
+		`{{ GetAllInterfaces | include "network" "198.51.100.0/24" | join "address" " " }}:10001`,
+		`{{ "10.0.0.1 10.0.0.2" }}:10001`,
+		`{{ GetPrivateIP :10001`,
+		loopback + "10001",
+		`{{ Unknown }}:10001`,
+	} {
+		if addr, err := NewListen(listen); err == nil {
+			t.Errorf("NewListen(%q) = %v, expected an error", listen, addr)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package habolt
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRetryJoinInterval = 30 * time.Second
+
+// Discovery finds the other nodes of the cluster, their Serf addresses are joined by Start
+// and retried periodically until a node answers (see Options.Discovery)
+type Discovery interface {
+	// Peers return the Serf addresses "host:port" found, the Serf port of our node is used
+	// for the addresses without port. Our own address is ignored.
+	Peers(ctx context.Context) ([]string, error)
+}
+
+// Advertiser is implemented by the Discovery providers which announce our node themselves
+// (i.e. MDNSDiscovery), Advertise announces "addr" in background until "ctx" is done
+type Advertiser interface {
+	Advertise(ctx context.Context, addr *HaAddress) error
+}
+
+// FileDiscovery reads the Serf addresses in a file, separated by spaces, commas or new lines
+// ("#" starts a comment). The file is read again when it is modified.
+type FileDiscovery struct {
+	Path string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	peers   []string
+}
+
+// NewFileDiscovery create a FileDiscovery reading the file "path"
+func NewFileDiscovery(path string) *FileDiscovery {
+	return &FileDiscovery{Path: path}
+}
+
+// Peers return the addresses of the file, kept until it is modified
+func (d *FileDiscovery) Peers(ctx context.Context) ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	info, err := os.Stat(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	if info.ModTime().Equal(d.modTime) {
+		return d.peers, nil
+	}
+
+	file, err := os.Open(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var peers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		peers = append(peers, strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	d.peers, d.modTime = peers, info.ModTime()
+	return peers, nil
+}
+
+// DNSDiscovery resolves the Serf addresses thanks the DNS: the A/AAAA records of Name with Port
+// (our Serf port if zero), or the SRV records of Name if SRV is true (i.e. "_serf._tcp.habolt.example.com")
+type DNSDiscovery struct {
+	Name string
+	Port uint16
+	SRV  bool
+}
+
+// Peers return the addresses resolved from the DNS
+func (d *DNSDiscovery) Peers(ctx context.Context) ([]string, error) {
+	var peers []string
+	if d.SRV {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range records {
+			peers = append(peers, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+		}
+		return peers, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if d.Port == 0 {
+			peers = append(peers, ip.IP.String())
+		} else {
+			peers = append(peers, net.JoinHostPort(ip.IP.String(), strconv.Itoa(int(d.Port))))
+		}
+	}
+	return peers, nil
+}
+
+// discover return the Serf addresses found by our Discovery, without our own address
+func (has *HaStore) discover(ctx context.Context) []string {
+	found, err := has.discovery.Peers(ctx)
+	if err != nil {
+		has.Logger().Printf("[WARN] HaStore: Discovery failed > %v", err)
+		return nil
+	}
+	self := has.realAddr().String()
+	var peers []string
+	for _, peer := range found {
+		addr, err := NewListen(peer)
+		if err != nil {
+			has.Logger().Printf("[WARN] HaStore: Discovery of an invalid address %s > %v", peer, err)
+			continue
+		}
+		if addr.Port == 0 {
+			addr.Port = has.realAddr().Port
+		}
+		if addr.String() != self && addr.String() != has.Bind.String() {
+			peers = append(peers, addr.String())
+		}
+	}
+	return peers
+}
+
+// retryJoin joins the nodes found by our Discovery every retryJoinInterval while we are
+// alone in the Serf cluster, until we have a Raft state (our own cluster could not be merged
+// with another one, see admit), "ctx" is done or Shutdown
+func (has *HaStore) retryJoin(ctx context.Context) {
+	ticker := time.NewTicker(has.retryJoinInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if has.raftServer.LastIndex() > 0 {
+				return
+			}
+			if has.serfServer.NumNodes() > 1 {
+				continue
+			}
+			peers := has.discover(ctx)
+			if len(peers) == 0 {
+				continue
+			}
+			if n, err := has.serfServer.Join(peers, false); err != nil {
+				has.Logger().Printf("[WARN] HaStore: Retry join of %v, %d joined > %v", peers, n, err)
+			} else {
+				has.Logger().Printf("[INFO] HaStore: Retry join of %v, %d joined", peers, n)
+			}
+		case <-ctx.Done():
+			return
+		case <-has.shutdownCh:
+			return
+		}
+	}
+}
+
+// startDiscovery announces our node if our Discovery is an Advertiser,
+// the returned context is done on Shutdown
+func (has *HaStore) startDiscovery(ctx context.Context) (context.Context, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-has.shutdownCh:
+			cancel()
+		}
+	}()
+	if adv, ok := has.discovery.(Advertiser); ok {
+		if err := adv.Advertise(ctx, has.realAddr()); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	return ctx, nil
+}
@@ -0,0 +1,168 @@
+package habolt
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	mdnsService = "_habolt._tcp"
+	mdnsDomain  = "local."
+	mdnsTimeout = time.Second
+	mdnsTTL     = 120
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MDNSDiscovery finds the nodes on the local network thanks multicast DNS (IPv4),
+// every node announces its Serf address as the service Service (default "_habolt._tcp")
+type MDNSDiscovery struct {
+	Service string
+	// Interface used for multicast, the system default if nil
+	Interface *net.Interface
+	// Timeout is how long we wait for the answers of the other nodes (default 1s)
+	Timeout time.Duration
+}
+
+func (d *MDNSDiscovery) service() string {
+	if d.Service == "" {
+		return dns.Fqdn(mdnsService + "." + mdnsDomain)
+	}
+	return dns.Fqdn(d.Service + "." + mdnsDomain)
+}
+
+// Peers queries the service and return the addresses announced until Timeout
+func (d *MDNSDiscovery) Peers(ctx context.Context) ([]string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query := new(dns.Msg)
+	query.SetQuestion(d.service(), dns.TypePTR)
+	query.RecursionDesired = false
+	raw, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(raw, mdnsGroup); err != nil {
+		return nil, err
+	}
+
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = mdnsTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetReadDeadline(deadline)
+
+	var peers []string
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// deadline reached
+			return peers, nil
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil || !resp.Response || resp.Id != query.Id {
+			continue
+		}
+		peers = append(peers, mdnsPeers(resp)...)
+	}
+}
+
+// mdnsPeers return the addresses of the SRV records of "resp", thanks its A/AAAA records
+func mdnsPeers(resp *dns.Msg) []string {
+	ips := make(map[string]net.IP)
+	records := append(resp.Answer, resp.Extra...)
+	for _, rr := range records {
+		switch r := rr.(type) {
+		case *dns.A:
+			ips[r.Hdr.Name] = r.A
+		case *dns.AAAA:
+			ips[r.Hdr.Name] = r.AAAA
+		}
+	}
+	var peers []string
+	for _, rr := range records {
+		if srv, ok := rr.(*dns.SRV); ok {
+			if ip, ok := ips[srv.Target]; ok {
+				peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port))))
+			}
+		}
+	}
+	return peers
+}
+
+// Advertise answers the queries of our service with the address "addr" until "ctx" is done
+func (d *MDNSDiscovery) Advertise(ctx context.Context, addr *HaAddress) error {
+	ip := net.ParseIP(addr.Address)
+	if ip == nil {
+		return &net.AddrError{Err: "mDNS needs an IP address", Addr: addr.Address}
+	}
+	conn, err := net.ListenMulticastUDP("udp4", d.Interface, mdnsGroup)
+	if err != nil {
+		return err
+	}
+
+	service := d.service()
+	instance := addr.Md5() + "." + service
+	host := addr.Md5() + "." + mdnsDomain
+	header := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: mdnsTTL}
+	}
+	answer := []dns.RR{&dns.PTR{Hdr: header(service, dns.TypePTR), Ptr: instance}}
+	extra := []dns.RR{&dns.SRV{Hdr: header(instance, dns.TypeSRV), Port: addr.Port, Target: host}}
+	if ip4 := ip.To4(); ip4 != nil {
+		extra = append(extra, &dns.A{Hdr: header(host, dns.TypeA), A: ip4})
+	} else {
+		extra = append(extra, &dns.AAAA{Hdr: header(host, dns.TypeAAAA), AAAA: ip})
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				// closed
+				return
+			}
+			query := new(dns.Msg)
+			if err := query.Unpack(buf[:n]); err != nil || query.Response || !mdnsAsks(query, service) {
+				continue
+			}
+			resp := new(dns.Msg)
+			resp.SetReply(query)
+			resp.Authoritative = true
+			resp.Answer, resp.Extra = answer, extra
+			if raw, err := resp.Pack(); err == nil {
+				// unicast answer to the querier
+				conn.WriteToUDP(raw, from)
+			}
+		}
+	}()
+	return nil
+}
+
+// mdnsAsks return true if "query" asks the PTR records of "service"
+func mdnsAsks(query *dns.Msg, service string) bool {
+	for _, q := range query.Question {
+		if q.Name == service && (q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package habolt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writePeers(t *testing.T, path, peers string) {
+	if err := ioutil.WriteFile(path, []byte(peers), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// modified in the same clock tick as the previous read
+	future := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "habolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers")
+	d := NewFileDiscovery(path)
+	if _, err := d.Peers(context.Background()); err == nil {
+		t.Fatal("missing file read")
+	}
+
+	writePeers(t, path, "# the seeds\n10.0.0.1:7946, 10.0.0.2\t[::1]:7946 # local\n\n")
+	peers, err := d.Peers(context.Background())
+	if expected := []string{"10.0.0.1:7946", "10.0.0.2", "[::1]:7946"}; err != nil || !reflect.DeepEqual(peers, expected) {
+		t.Fatalf("peers %q: %v", peers, err)
+	}
+	writePeers(t, path, "10.0.0.3")
+	if peers, err = d.Peers(context.Background()); err != nil || len(peers) != 1 || peers[0] != "10.0.0.3" {
+		t.Fatalf("peers %q after the update: %v", peers, err)
+	}
+}
+
+func TestRetryJoin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a Serf/Raft cluster")
+	}
+	dir, err := ioutil.TempDir("", "habolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	leader := newTestHaStore(t, "127.0.0.1", nil)
+	waitFor(t, "the leadership", leader.IsLeader)
+
+	discovery := func(file string) func(*Options) {
+		path := filepath.Join(dir, file)
+		writePeers(t, path, "")
+		return func(opts *Options) {
+			opts.Discovery = NewFileDiscovery(path)
+			opts.RetryJoinInterval = 50 * time.Millisecond
+		}
+	}
+	// a non-voter waits for a discovered node, a voter bootstraps alone
+	nonvoterSetup := discovery("nonvoter")
+	nonvoter := newTestHaStore(t, "127.0.0.1", func(opts *Options) {
+		nonvoterSetup(opts)
+		opts.Nonvoter = true
+	})
+	alone := newTestHaStore(t, "127.0.0.1", discovery("alone"))
+	waitFor(t, "the leadership of the node alone", alone.IsLeader)
+
+	writePeers(t, filepath.Join(dir, "nonvoter"), leader.realAddr().String())
+	writePeers(t, filepath.Join(dir, "alone"), leader.realAddr().String())
+	waitFor(t, "the non-voter joined", func() bool {
+		addrs, err := leader.Addresses()
+		return err == nil && len(addrs) == 2
+	})
+	if nonvoter.serfServer.NumNodes() != 2 {
+		t.Fatalf("%d Serf nodes seen by the non-voter", nonvoter.serfServer.NumNodes())
+	}
+	time.Sleep(500 * time.Millisecond)
+	if n := alone.serfServer.NumNodes(); n != 1 {
+		t.Fatalf("the node bootstrapped alone joined %d Serf nodes", n)
+	}
+}
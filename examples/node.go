@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/hashicorp/go-sockaddr"
 	"github.com/redsux/habolt"
 )
 
@@ -16,17 +19,31 @@ var (
 	name     string
 	members  string
 	dbPath   string
+	raftDir  string
 	logLevel int
 	listen   string
 	bind     string
+	replica  bool
+	encrypt  string
+	keyring  string
+	address  string
+	mdns     bool
+	expect   int
 )
 
 func init() {
 	flag.StringVar(&name, "name", "toto", "Cluster node name (default: toto)")
 	flag.StringVar(&members, "members", "", "Cluster members (to join exisiting) split by comma, ex: 127.0.0.1:1111,127.0.0.1:2222")
 	flag.StringVar(&dbPath, "db", "./node.db", "DB Path, default : ./node.db")
+	flag.StringVar(&raftDir, "raft", "", "Raft data directory, kept across restarts (default: <db>.raft)")
 	flag.IntVar(&logLevel, "level", 1, "Log level (0 = DEBUG, 1 = INFO, 2 = WARNING, 3 = ERROR)")
 	flag.StringVar(&listen, "listen", ":10001", "Default Serf listening address 'host:port' (Raft Port = Serf + 1), default = ':10001'")
+	flag.BoolVar(&replica, "replica", false, "Join the cluster as a read replica (Raft non-voter), -members is required")
+	flag.StringVar(&encrypt, "encrypt", "", "Base64 gossip encryption key (16, 24 or 32 bytes), the same on every node")
+	flag.StringVar(&keyring, "keyring", "", "Gossip keyring file, kept across restarts and key rotations")
+	flag.StringVar(&address, "address", "{{ GetPrivateIP }}", "go-sockaddr template of the listening IP when -listen has no host, i.e. '{{ GetInterfaceIP \"eth0\" }}'")
+	flag.BoolVar(&mdns, "mdns", false, "Find the other nodes on the local network thanks multicast DNS, instead of -members")
+	flag.IntVar(&expect, "expect", 0, "Number of voters to wait for before bootstrapping a new cluster (default: bootstrap alone without -members)")
 	flag.StringVar(&bind, "bind", "", "Used for NAT Traversal, advertised listening address 'host:port' (Raft Port = port + 1)")
 }
 
@@ -64,9 +81,8 @@ func main() {
 		log.Fatal(err)
 	}
 	if lAddr.Address == "" {
-		if lAddr.Address, err = sockaddr.GetInterfaceIP("eth0"); err != nil {
-			log.Fatal(err)
-		}
+		// resolved by NewHaStore
+		lAddr.Address = address
 	}
 
 	if bind != "" {
@@ -77,31 +93,59 @@ func main() {
 
 	}
 
-	HAS, err := habolt.NewHaStore(lAddr, bAddr, &habolt.Options{Path: dbPath})
+	opts := &habolt.Options{Path: dbPath, RaftDir: raftDir, Nonvoter: replica, EncryptKey: encrypt, KeyringFile: keyring, BootstrapExpect: expect}
+	if mdns {
+		opts.Discovery = &habolt.MDNSDiscovery{}
+	}
+	HAS, err := habolt.NewHaStore(lAddr, bAddr, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
 	HAS.LogLevel(logLevel)
 
-	go HAS.Start(peers...)
+	if err := HAS.Start(context.Background(), peers...); err != nil {
+		log.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
 	ticker := time.NewTicker(time.Duration(4+rand.Intn(6)) * time.Second) // between 4 and 10 sec
-	ticker2 := time.NewTicker(40 * time.Second)                           // between 30 and 60 sec
 	ticker3 := time.NewTicker(60 * time.Second)
+	watch := HAS.Watch(context.Background(), name+"_*")
 
 	for {
 		select {
+		case <-signals:
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := HAS.Shutdown(ctx)
+			cancel()
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		case err := <-HAS.Errors():
+			fmt.Printf("[ERR] %v\n", err)
 		case <-ticker.C:
 			t := newToto(name)
 			HAS.Set(t.key(), t)
-		case <-ticker2.C:
-			var t []toto
-			if err := HAS.List(&t, name+"_*"); err != nil {
-				fmt.Printf("[ERR] %v", err.Error())
-			} else {
-				for _, v := range t {
-					fmt.Printf("\tName=%s Value=%v\n", v.Name, v.Value)
+		case evt := <-watch:
+			var t toto
+			if evt.Type == habolt.EventReset {
+				// a snapshot replaced the store, the changes in between are not sent
+				var totos []toto
+				if err := HAS.List(&totos, name+"_*"); err != nil {
+					fmt.Printf("[ERR] %v\n", err.Error())
 				}
+				for _, t := range totos {
+					fmt.Printf("\tName=%s Value=%v (reset)\n", t.Name, t.Value)
+				}
+			} else if evt.Type == habolt.EventDelete {
+				fmt.Printf("\tDeleted %s\n", evt.Key)
+			} else if err := evt.Decode(&t); err != nil {
+				fmt.Printf("[ERR] %v\n", err.Error())
+			} else {
+				fmt.Printf("\tName=%s Value=%v (revision %d)\n", t.Name, t.Value, evt.Revision)
 			}
 		case <-ticker3.C:
 			if srvs, err := HAS.Addresses(); err == nil {
@@ -0,0 +1,450 @@
+package habolt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	autopilotInterval     = 2 * time.Second
+	autopilotStatsTimeout = time.Second
+)
+
+// ErrQuorum when removing or demoting a voter would leave too few healthy voters for a quorum
+var ErrQuorum = errors.New("Raft quorum would be lost")
+
+// AutopilotConfig tunes how the leader manages the servers of the Raft cluster (HaStore only),
+// zero values are replaced by the defaults
+type AutopilotConfig struct {
+	// DeadServerGrace is how long a failed server stays in the Raft configuration
+	// before its removal (default 30s), a negative value removes it immediately
+	DeadServerGrace time.Duration
+
+	// StabilizationTime is how long a new server must be healthy before its promotion
+	// from non-voter to voter (default 10s), a negative value adds it as a voter immediately
+	StabilizationTime time.Duration
+
+	// LastContactThreshold is the maximum time since the last contact of a server
+	// with the leader to be healthy (default 500ms)
+	LastContactThreshold time.Duration
+
+	// MaxTrailingLogs is the maximum number of Raft log entries a server can trail
+	// the leader by to be healthy (default 250)
+	MaxTrailingLogs uint64
+}
+
+func (c *AutopilotConfig) defaults() {
+	if c.DeadServerGrace == 0 {
+		c.DeadServerGrace = 30 * time.Second
+	}
+	if c.StabilizationTime == 0 {
+		c.StabilizationTime = 10 * time.Second
+	}
+	if c.LastContactThreshold == 0 {
+		c.LastContactThreshold = 500 * time.Millisecond
+	}
+	if c.MaxTrailingLogs == 0 {
+		c.MaxTrailingLogs = 250
+	}
+}
+
+// ServerHealth is the health of a server of the Raft configuration, seen by the leader
+type ServerHealth struct {
+	// ID of the server in the Raft configuration (its node ID)
+	ID string
+	// Address is the Raft address of the server
+	Address string
+	// SerfStatus is the status of the server in the Serf cluster (alive, failed, left...)
+	SerfStatus string
+	Voter      bool
+	Leader     bool
+	// LastContact is the time since the last contact of the server with the leader, negative if unknown
+	LastContact time.Duration
+	// LastIndex is the last Raft log index stored by the server
+	LastIndex uint64
+	Healthy   bool
+	// StableSince is the time since the server is healthy, zero if it is not
+	StableSince time.Time
+}
+
+// serverStats are sent by every server to the leader
+type serverStats struct {
+	LastContact time.Duration `json:"last_contact"`
+	LastIndex   uint64        `json:"last_index"`
+	ClusterID   string        `json:"cluster_id,omitempty"`
+}
+
+// autopilot keeps the state of the servers, only meaningful on the leader
+type autopilot struct {
+	config AutopilotConfig
+	mutex  sync.Mutex
+	health map[raft.ServerID]*ServerHealth
+	// failed is when a server has been seen failed in the Serf cluster
+	failed map[raft.ServerID]time.Time
+	// demoted are the servers made non-voters by an operator (see DemoteVoter), never promoted
+	demoted map[raft.ServerID]bool
+}
+
+func newAutopilot(config AutopilotConfig) *autopilot {
+	config.defaults()
+	return &autopilot{
+		config:  config,
+		health:  make(map[raft.ServerID]*ServerHealth),
+		failed:  make(map[raft.ServerID]time.Time),
+		demoted: make(map[raft.ServerID]bool),
+	}
+}
+
+// healthy return false for a server known as unhealthy, an unknown server is considered healthy
+func (a *autopilot) healthy(id raft.ServerID) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	h, ok := a.health[id]
+	return !ok || h.Healthy
+}
+
+func (a *autopilot) setDemoted(id raft.ServerID, demoted bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if demoted {
+		a.demoted[id] = true
+	} else {
+		delete(a.demoted, id)
+	}
+}
+
+// reset forgets everything, i.e. when we lose the leadership
+func (a *autopilot) reset() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.health = make(map[raft.ServerID]*ServerHealth)
+	a.failed = make(map[raft.ServerID]time.Time)
+	a.demoted = make(map[raft.ServerID]bool)
+}
+
+// report return a copy of the health of every server, sorted by ID
+func (a *autopilot) report() []ServerHealth {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	res := make([]ServerHealth, 0, len(a.health))
+	for _, h := range a.health {
+		res = append(res, *h)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Stats is called by the leader to get the health statistics of a server, "node" is only used for logging
+func (e *rpcEndpoint) Stats(node string, reply *[]byte) (err error) {
+	e.has.Logger().Printf("[DEBUG] rpc: Stats requested by %s", node)
+	*reply, err = json.Marshal(e.has.localStats())
+	return
+}
+
+// Health is called by a follower to get the health report of the leader
+func (e *rpcEndpoint) Health(node string, reply *[]byte) error {
+	if e.has.raftServer.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+	var err error
+	*reply, err = json.Marshal(e.has.autopilot.report())
+	return err
+}
+
+// Health return the health of every server of the Raft configuration, computed by the
+// leader every few seconds (forwarded over RPC if we are a follower)
+func (has *HaStore) Health() ([]ServerHealth, error) {
+	if has.raftServer.State() == raft.Leader {
+		return has.autopilot.report(), nil
+	}
+	var raw []byte
+	if err := has.rpcLeader("Health", has.realAddr().String(), &raw); err != nil {
+		return nil, err
+	}
+	var res []ServerHealth
+	return res, json.Unmarshal(raw, &res)
+}
+
+func (has *HaStore) localStats() *serverStats {
+	stats := &serverStats{LastIndex: has.raftServer.LastIndex(), LastContact: -1, ClusterID: has.clusterID()}
+	if has.raftServer.State() == raft.Leader {
+		stats.LastContact = 0
+	} else if last := has.raftServer.LastContact(); !last.IsZero() {
+		stats.LastContact = time.Since(last)
+	}
+	return stats
+}
+
+// serverStats return the statistics of a server, asked over RPC if it is not ourself
+func (has *HaStore) serverStats(server raft.Server) (*serverStats, error) {
+	if server.ID == has.nodeID {
+		return has.localStats(), nil
+	}
+	var raw []byte
+	if err := has.rpcCall(string(server.Address), "Stats", has.realAddr().String(), &raw, autopilotStatsTimeout); err != nil {
+		return nil, err
+	}
+	stats := &serverStats{}
+	return stats, json.Unmarshal(raw, stats)
+}
+
+// serfMembers return the Serf members by Raft ID
+func (has *HaStore) serfMembers() map[raft.ServerID]serf.Member {
+	res := make(map[raft.ServerID]serf.Member)
+	for _, member := range has.serfServer.Members() {
+		id := serfMemberToPeer(member).ID
+		if prev, ok := res[id]; ok && prev.Status == serf.StatusAlive {
+			// the old member of a node which changed its address
+			continue
+		}
+		res[id] = member
+	}
+	return res
+}
+
+// quorumSafe return ErrQuorum if the voters left without the server "id"
+// are not enough healthy to keep a quorum
+func (has *HaStore) quorumSafe(servers []raft.Server, id raft.ServerID) error {
+	voters, healthy := 0, 0
+	for _, server := range servers {
+		if server.ID == id && server.Suffrage != raft.Voter {
+			// a non-voter does not count in the quorum
+			return nil
+		}
+		if server.ID == id || server.Suffrage != raft.Voter {
+			continue
+		}
+		voters++
+		if has.autopilot.healthy(server.ID) {
+			healthy++
+		}
+	}
+	if healthy < voters/2+1 {
+		return ErrQuorum
+	}
+	return nil
+}
+
+// removeServer removes the server "id" from the Raft configuration if the quorum is safe, leader only
+func (has *HaStore) removeServer(id raft.ServerID) raft.Future {
+	configFuture := has.raftServer.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return errorFuture{err}
+	}
+	if err := has.quorumSafe(configFuture.Configuration().Servers, id); err != nil {
+		return errorFuture{err}
+	}
+	has.autopilot.setDemoted(id, false)
+	return has.raftServer.RemoveServer(id, 0, raftTimeout)
+}
+
+// admit checks a server missing from the Raft configuration has no Raft state of another cluster
+// (i.e. it bootstrapped alone): Raft would truncate its conflicting logs, but not the writes already
+// applied to its Store. The refusal of "node" is recorded with the joins rejected by our join policy.
+func (has *HaStore) admit(peer raftPeer, node, cluster string) error {
+	configFuture := has.raftServer.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	for _, server := range configFuture.Configuration().Servers {
+		if server.ID == peer.ID {
+			return nil
+		}
+	}
+	stats, err := has.serverStats(raft.Server{ID: peer.ID, Address: peer.Address})
+	if err != nil {
+		// unreachable, it is added and gets our logs once it answers (like before it had a state)
+		has.Logger().Printf("[DEBUG] HaStore: Failed to get the stats of %s > %v", peer.ID, err)
+		return nil
+	}
+	if stats.LastIndex == 0 || (stats.ClusterID != "" && stats.ClusterID == has.clusterID()) {
+		return nil
+	}
+	reason := "Raft state of another cluster"
+	has.joinAuth.reject(node, cluster, reason)
+	return fmt.Errorf("Node %s has the %s (last index %d)", node, reason, stats.LastIndex)
+}
+
+// addServer adds a joining server as a non-voter, it will be promoted once stable
+// (see AutopilotConfig.StabilizationTime) unless "nonvoter" is true, leader only
+func (has *HaStore) addServer(peer raftPeer, nonvoter bool) raft.Future {
+	configFuture := has.raftServer.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return errorFuture{err}
+	}
+	for _, server := range configFuture.Configuration().Servers {
+		if server.ID != peer.ID {
+			continue
+		}
+		if server.Address != peer.Address {
+			// the server changed its address, this version of Raft keeps replicating
+			// to the old one: remove it first
+			if err := has.removeServer(peer.ID).Error(); err != nil {
+				return errorFuture{err}
+			}
+		} else if server.Suffrage == raft.Voter && !nonvoter {
+			return nil
+		}
+		break
+	}
+	if nonvoter {
+		return has.raftServer.AddNonvoter(peer.ID, peer.Address, 0, raftTimeout)
+	}
+	if has.autopilot.config.StabilizationTime < 0 {
+		return has.raftServer.AddVoter(peer.ID, peer.Address, 0, raftTimeout)
+	}
+	return has.raftServer.AddNonvoter(peer.ID, peer.Address, 0, raftTimeout)
+}
+
+// autopilotRun updates the health of every server, promotes the stable servers
+// and removes the dead ones, leader only
+func (has *HaStore) autopilotRun() {
+	if has.raftServer.State() != raft.Leader {
+		has.autopilot.reset()
+		return
+	}
+	configFuture := has.raftServer.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		has.Logger().Printf("[ERR] autopilot: Failed to get the Raft configuration > %v", err)
+		return
+	}
+	servers := configFuture.Configuration().Servers
+	members := has.serfMembers()
+
+	has.updateHealth(servers, members)
+	has.promoteServers(servers, members)
+	has.removeDeadServers(servers, members)
+}
+
+func (has *HaStore) updateHealth(servers []raft.Server, members map[raft.ServerID]serf.Member) {
+	var (
+		wg    sync.WaitGroup
+		stats = make([]*serverStats, len(servers))
+	)
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server raft.Server) {
+			defer wg.Done()
+			var err error
+			if stats[i], err = has.serverStats(server); err != nil {
+				has.Logger().Printf("[DEBUG] autopilot: Failed to get the stats of %s > %v", server.ID, err)
+			}
+		}(i, server)
+	}
+	wg.Wait()
+
+	config := has.autopilot.config
+	self := has.nodeID
+	leaderIndex := has.raftServer.LastIndex()
+	now := time.Now()
+
+	health := make(map[raft.ServerID]*ServerHealth)
+	has.autopilot.mutex.Lock()
+	defer has.autopilot.mutex.Unlock()
+	for i, server := range servers {
+		h := &ServerHealth{
+			ID:          string(server.ID),
+			Address:     string(server.Address),
+			SerfStatus:  serf.StatusNone.String(),
+			Voter:       server.Suffrage == raft.Voter,
+			Leader:      server.ID == self,
+			LastContact: -1,
+		}
+		member, known := members[server.ID]
+		if known {
+			h.SerfStatus = member.Status.String()
+		}
+		if stats[i] != nil {
+			h.LastContact = stats[i].LastContact
+			h.LastIndex = stats[i].LastIndex
+			h.Healthy = known && member.Status == serf.StatusAlive &&
+				h.LastContact >= 0 && h.LastContact <= config.LastContactThreshold &&
+				h.LastIndex+config.MaxTrailingLogs >= leaderIndex
+		}
+		if h.Healthy {
+			h.StableSince = now
+			if prev, ok := has.autopilot.health[server.ID]; ok && prev.Healthy {
+				h.StableSince = prev.StableSince
+			}
+		}
+		health[server.ID] = h
+	}
+	has.autopilot.health = health
+}
+
+// promoteServers promotes the stable non-voters of the Raft configuration which advertise
+// the voter role in their Serf tags, the candidates come from the cluster state so a new
+// leader promotes the servers added by the previous one
+func (has *HaStore) promoteServers(servers []raft.Server, members map[raft.ServerID]serf.Member) {
+	var promote []raft.Server
+	has.autopilot.mutex.Lock()
+	for _, server := range servers {
+		member, known := members[server.ID]
+		if server.Suffrage != raft.Nonvoter || !known || member.Tags[serfTagRole] != serfRoleVoter || has.autopilot.demoted[server.ID] {
+			continue
+		}
+		if reason := has.joinAuth.check(member); reason != "" {
+			// i.e. added before the join policy was set
+			continue
+		}
+		h, ok := has.autopilot.health[server.ID]
+		if ok && h.Healthy && time.Since(h.StableSince) >= has.autopilot.config.StabilizationTime {
+			promote = append(promote, server)
+		}
+	}
+	has.autopilot.mutex.Unlock()
+
+	for _, server := range promote {
+		if err := has.raftServer.AddVoter(server.ID, server.Address, 0, raftTimeout).Error(); err != nil {
+			has.Logger().Printf("[ERR] autopilot: Failed to promote %s > %v", server.ID, err)
+			continue
+		}
+		has.Logger().Printf("[INFO] autopilot: Promoted %s to voter", server.ID)
+	}
+}
+
+func (has *HaStore) removeDeadServers(servers []raft.Server, members map[raft.ServerID]serf.Member) {
+	var dead []raft.ServerID
+	now := time.Now()
+	has.autopilot.mutex.Lock()
+	for _, server := range servers {
+		member, ok := members[server.ID]
+		if !ok || member.Status != serf.StatusFailed {
+			delete(has.autopilot.failed, server.ID)
+			continue
+		}
+		since, ok := has.autopilot.failed[server.ID]
+		if !ok {
+			has.autopilot.failed[server.ID] = now
+			since = now
+		}
+		if now.Sub(since) >= has.autopilot.config.DeadServerGrace {
+			dead = append(dead, server.ID)
+		}
+	}
+	has.autopilot.mutex.Unlock()
+
+	for _, id := range dead {
+		if err := has.removeServer(id).Error(); err != nil {
+			has.Logger().Printf("[WARN] autopilot: Dead server %s not removed > %v", id, err)
+			continue
+		}
+		has.Logger().Printf("[INFO] autopilot: Removed dead server %s", id)
+	}
+}
+
+// errorFuture is a raft.Future already failed
+type errorFuture struct {
+	err error
+}
+
+func (e errorFuture) Error() error {
+	return e.err
+}
@@ -0,0 +1,76 @@
+package habolt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestAutopilotPromotion(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a Serf/Raft cluster")
+	}
+	leader := newTestHaStore(t, "127.0.0.1", func(opts *Options) {
+		opts.Autopilot.StabilizationTime = 100 * time.Millisecond
+	})
+	waitFor(t, "the leadership", leader.IsLeader)
+	follower := newTestHaStore(t, "127.0.0.1", nil, leader.realAddr().String())
+
+	// added as a non-voter, then promoted once stable
+	waitFor(t, "the follower as non-voter", func() bool {
+		health, err := leader.Health()
+		return err == nil && len(health) == 2
+	})
+	waitFor(t, "the promotion of the follower", func() bool {
+		health, err := follower.Health()
+		if err != nil || len(health) != 2 {
+			return false
+		}
+		for _, h := range health {
+			if !h.Voter || !h.Healthy || h.SerfStatus != serf.StatusAlive.String() {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestAutopilotDeadServer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a Serf/Raft cluster")
+	}
+	leader := newTestHaStore(t, "127.0.0.1", func(opts *Options) {
+		opts.Autopilot.DeadServerGrace = 100 * time.Millisecond
+	})
+	waitFor(t, "the leadership", leader.IsLeader)
+	follower := newTestHaStore(t, "127.0.0.1", nil, leader.realAddr().String())
+	waitFor(t, "the follower as voter", func() bool {
+		addrs, err := leader.Addresses()
+		return err == nil && len(addrs) == 2
+	})
+
+	servers := func() []raft.Server {
+		configFuture := leader.raftServer.GetConfiguration()
+		if err := configFuture.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return configFuture.Configuration().Servers
+	}
+	// the follower seen failed in the Serf cluster, it is only removed after the grace period
+	members := leader.serfMembers()
+	failed := members[follower.nodeID]
+	failed.Status = serf.StatusFailed
+	members[follower.nodeID] = failed
+	leader.removeDeadServers(servers(), members)
+	if len(servers()) != 2 {
+		t.Fatal("failed server removed before the grace period")
+	}
+	// the autopilot of the leader sees it alive and resets its failure time every few seconds
+	waitFor(t, "the removal after the grace period", func() bool {
+		leader.removeDeadServers(servers(), members)
+		remaining := servers()
+		return len(remaining) == 1 && remaining[0].ID == leader.nodeID
+	})
+}
@@ -1,17 +1,35 @@
 package habolt
 
 import (
+	"bufio"
 	"encoding/json"
+	"fmt"
 	"io"
+	"sync/atomic"
 
+	"github.com/boltdb/bolt"
 	"github.com/hashicorp/raft"
 )
 
 type command struct {
-	Op    string      `json:"op"`
-	Key   string      `json:"key"`
-	Value interface{} `json:"value,omitempty"`
-	Addr  string      `json:"addr,omitempty"`
+	Op      string          `json:"op"`
+	Bucket  string          `json:"bucket,omitempty"`
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Version uint64          `json:"version,omitempty"`
+	Expire  int64           `json:"expire,omitempty"`
+	Txn     []txnOp         `json:"txn,omitempty"`
+	Now     int64           `json:"now,omitempty"`
+	Addr    string          `json:"addr,omitempty"`
+}
+
+// setValue "json.Marshal" the "value" of the command, so the FSM stores it as is
+// (no float64 numbers, same keys order). A nil "value" is kept nil.
+func (c *command) setValue(value interface{}) (err error) {
+	if value != nil {
+		c.Value, err = json.Marshal(value)
+	}
+	return err
 }
 
 type fsm struct {
@@ -24,21 +42,54 @@ func (f *fsm) Apply(l *raft.Log) interface{} {
 		c command
 		e error
 	)
+	// Raft applies again the logs after its last snapshot when it restarts,
+	// our BoltDB already contains the changes up to its applied index
+	if l.Index <= atomic.LoadUint64(&f.appliedIndex) {
+		return nil
+	}
+	defer atomic.StoreUint64(&f.appliedIndex, l.Index)
+
 	if err := json.Unmarshal(l.Data, &c); err != nil {
 		f.Logger().Printf("[ERR] fsm: Failed to unmarshal command: %s", err.Error())
+		return err
 	}
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
+	// the log index is written with the change, in the same BoltDB transaction
+	root := f.store.atIndex(l.Index)
+	store := root
+	if c.Bucket != "" {
+		store = root.Bucket(c.Bucket)
+	}
+
 	switch c.Op {
 	case "set":
 		if c.Value != nil {
-			e = f.store.Set(c.Key, c.Value)
+			e = store.setExpire(c.Key, c.Value, c.Expire)
 		}
+	case "cas":
+		// a nil value is stored as JSON null, once the version checked
+		e = store.compareAndSet(c.Key, c.Version, c.Value, c.Now)
 	case "del":
-		e = f.store.Delete(c.Key)
+		e = store.Delete(c.Key)
+	case "cad":
+		e = store.compareAndDelete(c.Key, c.Version, c.Now)
+	case "expire":
+		e = store.deleteExpired(c.Txn)
+	case "txn":
+		resp, err := store.commitTxn(c.Txn, c.Now)
+		if err != nil {
+			return err
+		}
+		return resp
+	case "mkbucket":
+		e = root.CreateBucket(c.Bucket)
+	case "rmbucket":
+		e = root.DropBucket(c.Bucket)
 	default:
 		f.Logger().Printf("[ERR] fsm: Unrecognized command op: %s", c.Op)
+		e = fmt.Errorf("Unrecognized command op %s", c.Op)
 	}
 
 	return e
@@ -49,48 +100,57 @@ func (f *fsm) Apply(l *raft.Log) interface{} {
 // Persist encodes the needed data from fsmsnapshot and transport it to
 // Restore where the necessary data is replicated into the finite state machine.
 // This allows the consensus algorithm to truncate the replicated log.
+// Only a BoltDB read transaction is opened here, it is a consistent view of
+// the store which Persist iterates without our lock.
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
-	content, err := f.ListRaw()
+	tx, err := f.store.conn.Begin(false)
 	if err != nil {
 		return nil, err
 	}
-
-	return &fsmSnapshot{kvMap: content}, nil
+	return &fsmSnapshot{store: f.store, tx: tx, codec: f.snapCodec}, nil
 }
 
 // Restore stores the key-value store to a previous state.
-func (f *fsm) Restore(kvMap io.ReadCloser) error {
-	kvSnapshot := make(map[string]string)
-	if err := json.NewDecoder(kvMap).Decode(&kvSnapshot); err != nil {
-		return err
-	}
+// The whole BoltDB is replaced atomically: values are written verbatim
+// and keys or buckets absent from the snapshot are removed.
+// A snapshot without our header is rejected (see ErrSnapshotFormat).
+// Once restored, our applied index is the index of the snapshot.
+func (f *fsm) Restore(source io.ReadCloser) error {
+	r := bufio.NewReader(source)
 
-	for k, v := range kvSnapshot {
-		if err := f.store.Set(k, v); err != nil {
-			return err
-		}
-	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
 
+	if !isSnapshot(r) {
+		// i.e. the flat JSON map of the first versions, restoring it would empty the store
+		return ErrSnapshotFormat
+	}
+	index := atomic.LoadUint64(&f.restoreIndex)
+	if err := f.store.readSnapshot(r, index); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&f.appliedIndex, index)
+	// the changes replaced by the snapshot are unknown, our watchers have to read the keys again
+	f.store.notifyReset()
 	return nil
 }
 
 type fsmSnapshot struct {
-	kvMap map[string]string
+	store *StaticStore
+	tx    *bolt.Tx
+	codec SnapshotCodec
 }
 
+// Persist streams the read transaction to the sink, the BoltDB is not
+// loaded in memory. Note that BoltDB can't remap its file while the
+// transaction is open, a write growing the file waits for Persist.
 func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	err := func() error {
-		// Encode data.
-		b, err := json.Marshal(f.kvMap)
-		if err != nil {
-			return err
-		}
-
 		// Write data to sink.
-		if _, err := sink.Write(b); err != nil {
+		if err := f.store.writeSnapshot(f.tx, sink, f.codec); err != nil {
 			return err
 		}
 
@@ -110,4 +170,7 @@ func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	return nil
 }
 
-func (f *fsmSnapshot) Release() {}
+// Release ends the read transaction
+func (f *fsmSnapshot) Release() {
+	f.tx.Rollback()
+}
@@ -0,0 +1,62 @@
+package habolt
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func applyLog(t *testing.T, f *fsm, index uint64, c *command) interface{} {
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Apply(&raft.Log{Index: index, Type: raft.LogCommand, Data: data})
+}
+
+func TestApplyReplayed(t *testing.T) {
+	f := newTestFsm(t, CodecNone)
+	logs := []*command{
+		{Op: "set", Key: "a", Value: json.RawMessage(`1`)},
+		{Op: "set", Key: "a", Value: json.RawMessage(`2`)},
+		{Op: "cas", Key: "a", Version: 2, Value: json.RawMessage(`3`)},
+		{Op: "mkbucket", Bucket: "other"},
+	}
+	for i, c := range logs {
+		if resp := applyLog(t, f, uint64(i+1), c); resp != nil {
+			t.Fatalf("log %d: %v", i+1, resp)
+		}
+	}
+	index, err := f.store.appliedIndex()
+	if err != nil || index != 4 {
+		t.Fatalf("applied index %d stored: %v", index, err)
+	}
+
+	// a restart loads the stored index, then Raft applies the same logs again
+	f.appliedIndex = index
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := f.store.Watch(ctx)
+	for i, c := range logs {
+		if resp := applyLog(t, f, uint64(i+1), c); resp != nil {
+			t.Fatalf("log %d replayed: %v", i+1, resp)
+		}
+	}
+	var value int
+	version, err := f.store.GetWithVersion("a", &value)
+	if err != nil || value != 3 || version != 3 {
+		t.Fatalf("a = %d version %d after the replay: %v", value, version, err)
+	}
+	if len(events) > 0 {
+		t.Fatalf("event %+v sent by a replayed log", <-events)
+	}
+
+	if resp := applyLog(t, f, 5, &command{Op: "set", Key: "a", Value: json.RawMessage(`4`)}); resp != nil {
+		t.Fatal(resp)
+	}
+	if index, _ := f.store.appliedIndex(); index != 5 {
+		t.Fatalf("applied index %d stored", index)
+	}
+}
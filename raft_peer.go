@@ -0,0 +1,212 @@
+package habolt
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	nodeIDFileName    = "node-id"
+	clusterIDFileName = "cluster-id"
+	raftDirSuffix     = ".raft"
+
+	serfTagID   = "id"
+	serfTagRaft = "raft"
+)
+
+// raftPeer is a server of the Raft configuration: its stable node ID and its Raft address
+type raftPeer struct {
+	ID      raft.ServerID
+	Address raft.ServerAddress
+}
+
+// legacyPeer is the peer of a node which does not advertise its identity,
+// identified by its Raft address derived from its Serf address (Serf port + 1)
+func legacyPeer(addr *HaAddress) raftPeer {
+	raftAddr := addr.Raft()
+	return raftPeer{ID: raftAddr.raftID(), Address: raftAddr.raftAddress()}
+}
+
+// serfMemberToPeer return the Raft identity advertised in the Serf tags of "member"
+func serfMemberToPeer(member serf.Member) raftPeer {
+	peer := legacyPeer(serfMemberToListen(member))
+	if id := member.Tags[serfTagID]; id != "" {
+		peer.ID = raft.ServerID(id)
+	}
+	if addr := member.Tags[serfTagRaft]; addr != "" {
+		peer.Address = raft.ServerAddress(addr)
+	}
+	return peer
+}
+
+// self return our own Raft identity
+func (has *HaStore) self() raftPeer {
+	return raftPeer{ID: has.nodeID, Address: has.raftAdvertise.raftAddress()}
+}
+
+// lookupPeer return the Raft identity of the node with the Serf address "addr",
+// thanks its Serf tags if it is a member of our Serf cluster
+func (has *HaStore) lookupPeer(addr *HaAddress) raftPeer {
+	name := addr.String()
+	for _, member := range has.serfServer.Members() {
+		if member.Name == name {
+			return serfMemberToPeer(member)
+		}
+	}
+	return legacyPeer(addr)
+}
+
+// raftPath return the Raft data directory, next to our BoltDB by default ("<Path>.raft"):
+// it must be as stable as the BoltDB, whatever our addresses
+func (has *HaStore) raftPath() string {
+	if has.raftDir == "" {
+		return has.store.path + raftDirSuffix
+	}
+	return has.raftDir
+}
+
+// loadNodeID return our node ID persisted in the Raft directory, "id" if not empty, otherwise a new one.
+// A node restarted with the Raft state of a previous version keeps its Raft address as ID.
+func (has *HaStore) loadNodeID(id string) (raft.ServerID, error) {
+	dir := has.raftPath()
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	idFile := filepath.Join(dir, nodeIDFileName)
+	data, err := ioutil.ReadFile(idFile)
+	switch {
+	case err == nil:
+		persisted := strings.TrimSpace(string(data))
+		if id != "" && id != persisted {
+			return "", fmt.Errorf("Node ID %s does not match the ID %s persisted in %s", id, persisted, idFile)
+		}
+		return raft.ServerID(persisted), nil
+	case !os.IsNotExist(err):
+		return "", err
+	}
+
+	if id == "" {
+		if _, err := os.Stat(filepath.Join(dir, raftStoreFileName)); err == nil {
+			id = string(has.raftAdvertise.raftID())
+		} else if id, err = newNodeID(); err != nil {
+			return "", err
+		}
+	}
+	return raft.ServerID(id), ioutil.WriteFile(idFile, []byte(id), 0600)
+}
+
+// newNodeID return a random UUID (version 4)
+func newNodeID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// loadClusterID return the ID of our Raft cluster persisted in the Raft directory, empty if unknown
+func (has *HaStore) loadClusterID() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(has.raftPath(), clusterIDFileName))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// clusterID return the ID of our Raft cluster, generated by the node which bootstrapped it
+// and learned from the leader by the others, empty if unknown yet
+func (has *HaStore) clusterID() string {
+	has.clusterMutex.Lock()
+	defer has.clusterMutex.Unlock()
+	return has.cluster
+}
+
+// setClusterID persists "id" as the ID of our Raft cluster, or a new one if "id" is empty
+func (has *HaStore) setClusterID(id string) (err error) {
+	if id == "" {
+		if id, err = newNodeID(); err != nil {
+			return
+		}
+	}
+	has.clusterMutex.Lock()
+	defer has.clusterMutex.Unlock()
+	if err = ioutil.WriteFile(filepath.Join(has.raftPath(), clusterIDFileName), []byte(id), 0600); err == nil {
+		has.cluster = id
+	}
+	return
+}
+
+// learnClusterID sets the ID of our Raft cluster once we are part of it: the one of the leader,
+// or a new one if we are the leader of a cluster bootstrapped by a previous version
+func (has *HaStore) learnClusterID() {
+	if has.clusterID() != "" || has.raftServer.LastIndex() == 0 {
+		return
+	}
+	var id string
+	if has.raftServer.State() != raft.Leader {
+		leader := has.raftServer.Leader()
+		if leader == "" {
+			return
+		}
+		stats, err := has.serverStats(raft.Server{Address: leader})
+		if err != nil || stats.ClusterID == "" {
+			return
+		}
+		id = stats.ClusterID
+	}
+	if err := has.setClusterID(id); err != nil {
+		has.Logger().Printf("[ERR] HaStore: Failed to store the cluster ID > %v", err)
+	}
+}
+
+// initIdentity sets our Raft addresses, derived from our Serf addresses (port + 1) if they
+// are not configured, and our node ID
+func (has *HaStore) initIdentity(opts *Options) (err error) {
+	var raftBind *HaAddress
+	if raftBind, err = opts.RaftBind.resolve(); err != nil {
+		return
+	}
+	if has.raftAdvertise, err = opts.RaftAdvertise.resolve(); err != nil {
+		return
+	}
+	has.raftBind = raftBind
+	if has.raftBind == nil {
+		has.raftBind = has.Bind.Raft()
+	}
+	if has.raftAdvertise == nil {
+		if raftBind == nil {
+			has.raftAdvertise = has.realAddr().Raft()
+		} else if ip := net.ParseIP(raftBind.Address); raftBind.Address == "" || (ip != nil && ip.IsUnspecified()) {
+			has.raftAdvertise = NewAddress(has.realAddr().Address, int(raftBind.Port))
+		} else {
+			has.raftAdvertise = raftBind
+		}
+	}
+	if has.nodeID, err = has.loadNodeID(opts.NodeID); err != nil {
+		return
+	}
+	has.cluster, err = has.loadClusterID()
+	return
+}
+
+// replaced return true if another alive member advertises the node ID of "member",
+// i.e. the node restarted with another address: the failure of its old member is ignored
+func (has *HaStore) replaced(member serf.Member) bool {
+	id := serfMemberToPeer(member).ID
+	for _, m := range has.serfServer.Members() {
+		if m.Name != member.Name && m.Status == serf.StatusAlive && serfMemberToPeer(m).ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,350 @@
+package habolt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/snappy"
+)
+
+// SnapshotCodec is the compression of the snapshots taken by an HaStore
+type SnapshotCodec byte
+
+const (
+	// CodecNone does not compress snapshots
+	CodecNone SnapshotCodec = iota
+	// CodecGzip compresses snapshots with gzip, smaller but slower
+	CodecGzip
+	// CodecSnappy compresses snapshots with snappy, fast
+	CodecSnappy
+)
+
+// Snapshot binary format, streamed record by record :
+//
+//	header  : magic "habolt" | version (1 byte) | codec (1 byte)
+//	records : compressed with the codec, type (1 byte) | fields, each field is its length (uvarint) followed by its bytes
+//	  snapBucket : name | revision (8 bytes big endian), starts a bucket
+//	  snapValue  : key | raw value, in the last bucket
+//	  snapMeta   : key | raw metadata, in the last bucket
+//	  snapEnd    : no field, followed by the CRC-32 (Castagnoli) of every previous byte
+const (
+	snapshotVersion = 1
+
+	snapEnd    byte = 0
+	snapBucket byte = 1
+	snapValue  byte = 2
+	snapMeta   byte = 3
+)
+
+var (
+	snapshotMagic = []byte("habolt")
+
+	// snapFields is the number of fields of each record type
+	snapFields = map[byte]int{snapEnd: 0, snapBucket: 2, snapValue: 2, snapMeta: 2}
+
+	snapTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrSnapshotFormat for a snapshot which is not in a format (or version) we know
+	ErrSnapshotFormat = errors.New("Snapshot format not supported")
+	// ErrSnapshotChecksum for a truncated or corrupted snapshot
+	ErrSnapshotChecksum = errors.New("Snapshot checksum mismatch")
+)
+
+type snapshotWriter struct {
+	body io.Writer
+	zip  io.WriteCloser
+	w    *bufio.Writer
+	crc  hash.Hash32
+	len  [binary.MaxVarintLen64]byte
+}
+
+// newSnapshotWriter writes the header to "out", the records following it are compressed with "codec"
+func newSnapshotWriter(out io.Writer, codec SnapshotCodec) (*snapshotWriter, error) {
+	w := &snapshotWriter{body: out, crc: crc32.New(snapTable)}
+	switch codec {
+	case CodecNone:
+	case CodecGzip:
+		w.zip = gzip.NewWriter(out)
+	case CodecSnappy:
+		w.zip = snappy.NewBufferedWriter(out)
+	default:
+		return nil, ErrSnapshotFormat
+	}
+	header := append(append([]byte(nil), snapshotMagic...), snapshotVersion, byte(codec))
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+	w.crc.Write(header)
+	if w.zip != nil {
+		w.body = w.zip
+	}
+	w.w = bufio.NewWriter(io.MultiWriter(w.body, w.crc))
+	return w, nil
+}
+
+func (w *snapshotWriter) record(typ byte, fields ...[]byte) error {
+	if err := w.w.WriteByte(typ); err != nil {
+		return err
+	}
+	for _, field := range fields {
+		n := binary.PutUvarint(w.len[:], uint64(len(field)))
+		if _, err := w.w.Write(w.len[:n]); err != nil {
+			return err
+		}
+		if _, err := w.w.Write(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close writes the end record and the checksum
+func (w *snapshotWriter) close() error {
+	if err := w.record(snapEnd); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.body.Write(w.crc.Sum(nil)); err != nil {
+		return err
+	}
+	if w.zip != nil {
+		return w.zip.Close()
+	}
+	return nil
+}
+
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+// newSnapshotReader reads the header from "r" and return a reader of the decompressed records
+func newSnapshotReader(r *bufio.Reader) (*snapshotReader, error) {
+	sr := &snapshotReader{r: r, crc: crc32.New(snapTable)}
+	magic, err := sr.read(uint64(len(snapshotMagic)))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, snapshotMagic) {
+		return nil, ErrSnapshotFormat
+	}
+	version, err := sr.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != snapshotVersion {
+		return nil, ErrSnapshotFormat
+	}
+	b, err := sr.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch SnapshotCodec(b) {
+	case CodecNone:
+	case CodecGzip:
+		zip, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		sr.r = bufio.NewReader(zip)
+	case CodecSnappy:
+		sr.r = bufio.NewReader(snappy.NewReader(r))
+	default:
+		return nil, ErrSnapshotFormat
+	}
+	return sr, nil
+}
+
+func (r *snapshotReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (r *snapshotReader) read(n uint64) ([]byte, error) {
+	if n > bolt.MaxValueSize {
+		return nil, ErrSnapshotFormat
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, err
+	}
+	r.crc.Write(buf)
+	return buf, nil
+}
+
+func (r *snapshotReader) record() (byte, [][]byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	count, ok := snapFields[typ]
+	if !ok {
+		return 0, nil, ErrSnapshotFormat
+	}
+	fields := make([][]byte, count)
+	for i := range fields {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if fields[i], err = r.read(n); err != nil {
+			return 0, nil, err
+		}
+	}
+	return typ, fields, nil
+}
+
+// verify compares the checksum following the end record with our own
+func (r *snapshotReader) verify() error {
+	sum := make([]byte, crc32.Size)
+	if _, err := io.ReadFull(r.r, sum); err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, r.crc.Sum(nil)) {
+		return ErrSnapshotChecksum
+	}
+	return nil
+}
+
+// isSnapshot return true if "r" starts with our snapshot header, whatever its version
+func isSnapshot(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(snapshotMagic))
+	return err == nil && bytes.Equal(magic, snapshotMagic)
+}
+
+// writeSnapshot streams every bucket of the read transaction "tx", and its metadata, to "out"
+func (s *StaticStore) writeSnapshot(tx *bolt.Tx, out io.Writer, codec SnapshotCodec) error {
+	w, err := newSnapshotWriter(out, codec)
+	if err != nil {
+		return err
+	}
+	err = tx.ForEach(func(name []byte, data *bolt.Bucket) error {
+		if !validBucket(string(name)) {
+			return nil
+		}
+		metas := tx.Bucket([]byte(metaBucketPrefix + string(name)))
+		revision := make([]byte, 8)
+		if metas != nil {
+			binary.BigEndian.PutUint64(revision, metas.Sequence())
+		}
+		if err := w.record(snapBucket, name, revision); err != nil {
+			return err
+		}
+		err := data.ForEach(func(k, v []byte) error {
+			if v == nil {
+				// nested bucket
+				return nil
+			}
+			return w.record(snapValue, k, v)
+		})
+		if err != nil || metas == nil {
+			return err
+		}
+		return metas.ForEach(func(k, v []byte) error {
+			return w.record(snapMeta, k, v)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return w.close()
+}
+
+// readSnapshot replaces the whole content of our BoltDB with the snapshot streamed by "r",
+// in a single transaction which is only committed if the checksum matches.
+// "index" is the Raft log index of the snapshot, recorded as our applied index.
+// The expiry indexes are not in the snapshot, they are rebuilt from the metadata.
+func (s *StaticStore) readSnapshot(r *bufio.Reader, index uint64) error {
+	tx, err := s.conn.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := dropBuckets(tx); err != nil {
+		return err
+	}
+
+	sr, err := newSnapshotReader(r)
+	if err != nil {
+		return err
+	}
+	var data, metas, expires *bolt.Bucket
+	for {
+		typ, fields, err := sr.record()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case snapBucket:
+			if len(fields[1]) != 8 {
+				return ErrSnapshotFormat
+			}
+			if data, err = tx.CreateBucket(fields[0]); err != nil {
+				return err
+			}
+			if metas, err = tx.CreateBucket([]byte(metaBucketPrefix + string(fields[0]))); err != nil {
+				return err
+			}
+			if err := metas.SetSequence(binary.BigEndian.Uint64(fields[1])); err != nil {
+				return err
+			}
+			if expires, err = tx.CreateBucket([]byte(expireBucketPrefix + string(fields[0]))); err != nil {
+				return err
+			}
+		case snapValue, snapMeta:
+			bucket := data
+			if typ == snapMeta {
+				bucket = metas
+			}
+			if bucket == nil {
+				return ErrSnapshotFormat
+			}
+			if err := bucket.Put(fields[0], fields[1]); err != nil {
+				return err
+			}
+			if typ == snapMeta {
+				meta := &keyMeta{}
+				if err := json.Unmarshal(fields[1], meta); err != nil {
+					return ErrSnapshotFormat
+				}
+				if meta.ExpireAt != 0 {
+					if err := expires.Put(expireKey(meta.ExpireAt, string(fields[0])), nil); err != nil {
+						return err
+					}
+				}
+			}
+		case snapEnd:
+			if err := sr.verify(); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucketIfNotExists(s.rootBucket); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucketIfNotExists([]byte(metaBucketPrefix + string(s.rootBucket))); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucketIfNotExists([]byte(expireBucketPrefix + string(s.rootBucket))); err != nil {
+				return err
+			}
+			if err := putAppliedIndex(tx, index); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package habolt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type memorySink struct {
+	bytes.Buffer
+}
+
+func (m *memorySink) ID() string    { return "memory" }
+func (m *memorySink) Cancel() error { return nil }
+func (m *memorySink) Close() error  { return nil }
+
+// newTestFsm return a FSM over a new StaticStore, without any Raft or Serf server
+func newTestFsm(t *testing.T, codec SnapshotCodec) *fsm {
+	dir, err := ioutil.TempDir("", "habolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewStaticStore(&Options{Path: filepath.Join(dir, "test.db"), LogOutput: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	return &fsm{&HaStore{haNode: &haNode{snapCodec: codec}, store: db}}
+}
+
+func snapshot(t *testing.T, f *fsm) []byte {
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+	sink := &memorySink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+	return sink.Bytes()
+}
+
+func restore(f *fsm, data []byte) error {
+	return f.Restore(ioutil.NopCloser(bytes.NewReader(data)))
+}
+
+// fill writes values, metadata (versions and TTLs) and a second bucket
+func fill(t *testing.T, f *fsm) {
+	s := f.store
+	for i := 0; i < 100; i++ {
+		if err := s.Set(fmt.Sprintf("key%d", i), map[string]interface{}{"i": i, "s": "some text"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Set("key0", "updated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetWithTTL("ttl", 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateBucket("other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Bucket("other").Set("nested", 1.5); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, codec := range []SnapshotCodec{CodecNone, CodecGzip, CodecSnappy} {
+		t.Run(fmt.Sprint(codec), func(t *testing.T) {
+			src := newTestFsm(t, codec)
+			fill(t, src)
+			data := snapshot(t, src)
+
+			dst := newTestFsm(t, codec)
+			if err := dst.store.Set("stale", 1); err != nil {
+				t.Fatal(err)
+			}
+			if err := dst.store.CreateBucket("stalebucket"); err != nil {
+				t.Fatal(err)
+			}
+			dst.restoreIndex = 42
+			if err := restore(dst, data); err != nil {
+				t.Fatal(err)
+			}
+			if index := dst.AppliedIndex(); index != 42 {
+				t.Fatalf("applied index %d after the restore", index)
+			}
+			if index, err := dst.store.appliedIndex(); err != nil || index != 42 {
+				t.Fatalf("applied index %d stored by the restore: %v", index, err)
+			}
+
+			if again := snapshot(t, dst); !bytes.Equal(data, again) {
+				t.Fatal("snapshot of the restored store differs")
+			}
+			var value string
+			if err := dst.store.Get("stale", &value); err != ErrKeyNotFound {
+				t.Fatalf("stale key restored: %v", err)
+			}
+			buckets, err := dst.store.Buckets()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(buckets) != "[default other]" {
+				t.Fatalf("buckets %v", buckets)
+			}
+			srcVersion, _ := src.store.GetWithVersion("key0", &value)
+			dstVersion, err := dst.store.GetWithVersion("key0", &value)
+			if err != nil || value != "updated" || dstVersion != srcVersion {
+				t.Fatalf("key0 = %q version %d (expected %d): %v", value, dstVersion, srcVersion, err)
+			}
+			// the revision (bucket sequence) continues after the restored one
+			if err := dst.store.Set("new", 1); err != nil {
+				t.Fatal(err)
+			}
+			if version, _ := dst.store.GetWithVersion("new", &value); version <= srcVersion {
+				t.Fatalf("revision %d not restored", version)
+			}
+		})
+	}
+}
+
+func TestSnapshotRejected(t *testing.T) {
+	src := newTestFsm(t, CodecNone)
+	fill(t, src)
+	data := snapshot(t, src)
+	gzipped := newTestFsm(t, CodecGzip)
+	fill(t, gzipped)
+	zipped := snapshot(t, gzipped)
+
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	zipCorrupted := append([]byte(nil), zipped...)
+	zipCorrupted[len(zipCorrupted)/2] ^= 0xff
+
+	for name, bad := range map[string][]byte{
+		"truncated":       data[:len(data)-3],
+		"truncated body":  data[:len(data)/2],
+		"corrupted":       corrupted,
+		"gzip truncated":  zipped[:len(zipped)/2],
+		"gzip corrupted":  zipCorrupted,
+		"unknown codec":   append([]byte("habolt\x01\x09"), data[8:]...),
+		"unknown version": append([]byte("habolt\x02\x00"), data[8:]...),
+		"flat json":       []byte(`{"foo":"\"bar\""}`),
+		"garbage":         []byte("not a snapshot"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dst := newTestFsm(t, CodecNone)
+			if err := dst.store.Set("kept", "value"); err != nil {
+				t.Fatal(err)
+			}
+			if err := restore(dst, bad); err == nil {
+				t.Fatal("snapshot accepted")
+			}
+			var value string
+			if err := dst.store.Get("kept", &value); err != nil || value != "value" {
+				t.Fatalf("store modified by a rejected snapshot: %q %v", value, err)
+			}
+		})
+	}
+}
+
+func TestSnapshotRestoreWatch(t *testing.T) {
+	src := newTestFsm(t, CodecNone)
+	fill(t, src)
+	data := snapshot(t, src)
+
+	dst := newTestFsm(t, CodecNone)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := dst.store.Watch(ctx)
+	other := dst.store.Bucket("other").Watch(ctx, "nested")
+	// a full channel still receives the reset
+	for i := 0; i < watchBuffer+10; i++ {
+		if err := dst.store.Set(fmt.Sprintf("key%d", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := restore(dst, data); err != nil {
+		t.Fatal(err)
+	}
+	var last WatchEvent
+	for len(events) > 0 {
+		last = <-events
+	}
+	if last.Type != EventReset || last.Bucket != "default" || last.Key != "" {
+		t.Fatalf("last event %+v, expected a reset", last)
+	}
+	if evt := <-other; evt.Type != EventReset || evt.Bucket != "other" {
+		t.Fatalf("event %+v, expected a reset", evt)
+	}
+
+	// the channels are closed with the store
+	dst.store.Close()
+	if _, ok := <-events; ok {
+		t.Fatal("channel still open after Close")
+	}
+	if _, ok := <-dst.store.Watch(ctx); ok {
+		t.Fatal("channel of a closed store still open")
+	}
+}
@@ -1,85 +1,243 @@
 package habolt
 
 import (
+	"encoding/json"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/raft-boltdb"
+	"github.com/hashicorp/serf/serf"
 )
 
 func (has *HaStore) initRaft() (err error) {
 	var (
-		raftStore *raftboltdb.BoltStore
-		raftSnaps *raft.FileSnapshotStore
+		raftSnaps raft.SnapshotStore
 		raftTrans *raft.NetworkTransport
 		raftConf  = raft.DefaultConfig()
 	)
 
-	if raftStore, raftSnaps, err = has.raftStores(); err != nil {
+	if has.raftStore, raftSnaps, err = has.raftStores(); err != nil {
 		return
 	}
+	if has.raftState, err = raft.HasExistingState(has.raftStore, has.raftStore, raftSnaps); err != nil {
+		return
+	}
+	// our FSM skips the logs already in our Store when Raft replays them,
+	// without Raft state the logs start again from the first one
+	if has.raftState {
+		if has.appliedIndex, err = has.store.appliedIndex(); err != nil {
+			return
+		}
+	}
 	if raftTrans, err = has.raftTransport(); err != nil {
 		return
 	}
 
-	raftConf.LocalID = has.realAddr().Raft().raftID()
+	raftConf.LocalID = has.nodeID
 	raftConf.Logger = has.store.Logger()
+	// A leader demoting itself (see TransferLeadership) stays a follower
+	raftConf.ShutdownOnRemove = false
+	raftConf.NotifyCh = has.leaderNotify
 
-	has.raftServer, err = raft.NewRaft(raftConf, &fsm{has}, raftStore, raftStore, raftSnaps, raftTrans)
+	if has.raftServer, err = raft.NewRaft(raftConf, &fsm{has}, has.raftStore, has.raftStore, raftSnaps, raftTrans); err != nil {
+		return
+	}
+	go has.leaderLoop()
 	return
 }
 
-func (has *HaStore) raftStores() (store *raftboltdb.BoltStore, snapshot *raft.FileSnapshotStore, err error) {
-	dbPath := "/tmp"
-	dbPath = filepath.Join(dbPath, has.realAddr().Raft().Md5())
-	if err = os.RemoveAll(dbPath + "/"); err != nil {
-		return
-	}
+func (has *HaStore) raftStores() (store *raftboltdb.BoltStore, snapshot raft.SnapshotStore, err error) {
+	dbPath := has.raftPath()
 	if err = os.MkdirAll(dbPath, 0777); err != nil {
 		return
 	}
-	dbFile := filepath.Join(dbPath, "raft.db")
+	dbFile := filepath.Join(dbPath, raftStoreFileName)
 	if store, err = raftboltdb.NewBoltStore(dbFile); err != nil {
 		return
 	}
-	snapshot, err = raft.NewFileSnapshotStoreWithLogger(dbPath, retainSnapshotCount, has.Logger())
+	var files *raft.FileSnapshotStore
+	if files, err = raft.NewFileSnapshotStoreWithLogger(dbPath, retainSnapshotCount, has.Logger()); err != nil {
+		return
+	}
+	snapshot = &snapshotStore{files, has.haNode}
 	return
 }
 
+// snapshotStore records the index of the snapshots opened by Raft, Raft always opens
+// the snapshot before giving it to our FSM so Restore knows the index it restores
+type snapshotStore struct {
+	raft.SnapshotStore
+	node *haNode
+}
+
+func (s *snapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, source, err := s.SnapshotStore.Open(id)
+	if err == nil {
+		atomic.StoreUint64(&s.node.restoreIndex, meta.Index)
+	}
+	return meta, source, err
+}
+
+// raftTransport listen on the Raft port, connections are shared between
+// the Raft protocol and our RPC server (see rpc_utils.go)
 func (has *HaStore) raftTransport() (transport *raft.NetworkTransport, err error) {
-	var tcpAddr *net.TCPAddr
-	if tcpAddr, err = net.ResolveTCPAddr("tcp", has.realAddr().Raft().String()); err != nil {
+	var (
+		tcpAddr *net.TCPAddr
+		list    net.Listener
+	)
+	if tcpAddr, err = net.ResolveTCPAddr("tcp", has.raftAdvertise.String()); err != nil {
 		return
 	}
-	transport, err = raft.NewTCPTransportWithLogger(has.Bind.Raft().String(), tcpAddr, 3, 10*time.Second, has.Logger())
+	if err = has.initRPC(); err != nil {
+		return
+	}
+	if list, err = net.Listen("tcp", has.raftBind.String()); err != nil {
+		return
+	}
+	has.listener = list
+	has.raftLayer = newRaftLayer(tcpAddr, has.tlsClient)
+	go has.listen(list)
+
+	transport = raft.NewNetworkTransportWithLogger(has.raftLayer, 3, 10*time.Second, has.Logger())
 	return
 }
 
-func (has *HaStore) raftBootstrap(peers ...string) error {
-	addr := has.realAddr().Raft()
+// raftBootstrap bootstraps a new cluster with ourself and the servers "peers", with a new cluster ID
+func (has *HaStore) raftBootstrap(peers ...raft.Server) error {
+	self := has.self()
 	bootstrapConfig := raft.Configuration{
 		Servers: []raft.Server{
 			{
 				Suffrage: raft.Voter,
-				ID:       addr.raftID(),
-				Address:  addr.raftAddress(),
+				ID:       self.ID,
+				Address:  self.Address,
 			},
 		},
 	}
 
-	for _, node := range peers {
-		if node != addr.String() {
-			bootstrapConfig.Servers = append(bootstrapConfig.Servers, raft.Server{
-				Suffrage: raft.Voter,
-				ID:       raft.ServerID(node),
-				Address:  raft.ServerAddress(node),
-			})
+	for _, peer := range peers {
+		if peer.ID != self.ID {
+			bootstrapConfig.Servers = append(bootstrapConfig.Servers, peer)
+		}
+	}
+
+	if err := has.raftServer.BootstrapCluster(bootstrapConfig).Error(); err != nil {
+		return err
+	}
+	return has.setClusterID("")
+}
+
+// expectBootstrap bootstraps the cluster once at least Options.BootstrapExpect voters are alive in our
+// Serf cluster, none of them with a Raft state yet. Only the voter with the lowest node ID bootstraps,
+// with every voter seen (more than expected is logged), the others wait for its logs. If it fails before,
+// it leaves the alive members and the next lowest one bootstraps. The non-voters join once a leader is
+// elected (see joinMembers). It return true when we are part of a cluster.
+func (has *HaStore) expectBootstrap() bool {
+	if has.raftServer.LastIndex() > 0 {
+		return true
+	}
+	var servers []raft.Server
+	for _, member := range has.serfServer.Members() {
+		if member.Status != serf.StatusAlive || member.Tags[serfTagRole] == serfRoleNonvoter || has.joinAuth.check(member) != "" {
+			continue
+		}
+		peer := serfMemberToPeer(member)
+		servers = append(servers, raft.Server{Suffrage: raft.Voter, ID: peer.ID, Address: peer.Address})
+	}
+	if len(servers) < has.bootstrapExpect {
+		return false
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+	if servers[0].ID != has.nodeID {
+		// added by the voter which bootstraps
+		return false
+	}
+	if len(servers) > has.bootstrapExpect {
+		has.Logger().Printf("[WARN] HaStore: %d voters seen but BootstrapExpect is %d, bootstrapping with all of them", len(servers), has.bootstrapExpect)
+	}
+
+	for _, peer := range servers[1:] {
+		stats, err := has.serverStats(peer)
+		if err != nil {
+			has.Logger().Printf("[DEBUG] HaStore: Bootstrap delayed, failed to get the stats of %s > %v", peer.ID, err)
+			return false
+		}
+		if stats.LastIndex > 0 {
+			// only a cluster bootstrapped without us, its leader adds us
+			has.Logger().Printf("[INFO] HaStore: Bootstrap skipped, %s is already part of a cluster", peer.ID)
+			return false
+		}
+	}
+	if err := has.raftBootstrap(servers[1:]...); err != nil {
+		has.Logger().Printf("[ERR] HaStore: Bootstrap failed > %v", err)
+		return false
+	}
+	has.Logger().Printf("[INFO] HaStore: Bootstrapped the cluster with %d voters", len(servers))
+	return true
+}
+
+// joinMembers adds to the Raft configuration the alive Serf members missing from it (i.e. the
+// non-voters seen before the bootstrap), if we are the leader. It return false while there is no leader.
+func (has *HaStore) joinMembers() bool {
+	switch {
+	case has.raftServer.State() != raft.Leader:
+		return has.raftServer.Leader() != ""
+	case has.raftServer.VerifyLeader().Error() != nil:
+		return false
+	}
+	configFuture := has.raftServer.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return false
+	}
+	known := make(map[raft.ServerID]bool)
+	for _, server := range configFuture.Configuration().Servers {
+		known[server.ID] = true
+	}
+	evt := serf.MemberEvent{Type: serf.EventMemberJoin}
+	for _, member := range has.serfServer.Members() {
+		if member.Status == serf.StatusAlive && !known[serfMemberToPeer(member).ID] {
+			evt.Members = append(evt.Members, member)
 		}
 	}
+	if err := has.serfMemberListener(evt); err != nil {
+		has.reportError(err)
+		return false
+	}
+	return true
+}
+
+// applyReply is the result of a command applied by the leader
+type applyReply struct {
+	// Index of the command in the Raft log
+	Index uint64 `json:"index"`
+	// Response is the JSON encoded response of our FSM, if not an error
+	Response json.RawMessage `json:"response,omitempty"`
+}
 
-	future := has.raftServer.BootstrapCluster(bootstrapConfig)
-	return future.Error()
+// raftApply append the command to the Raft log, only the leader can do it.
+// It returns the log index and the response once applied, or the error returned by our FSM.
+func (has *HaStore) raftApply(msg []byte) (*applyReply, error) {
+	future := has.raftServer.Apply(msg, raftTimeout)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	reply := &applyReply{Index: future.Index()}
+	switch resp := future.Response().(type) {
+	case nil:
+	case error:
+		return nil, resp
+	default:
+		raw, err := json.Marshal(resp)
+		if err != nil {
+			return nil, err
+		}
+		reply.Response = raw
+	}
+	return reply, nil
 }
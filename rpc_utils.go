@@ -0,0 +1,377 @@
+package habolt
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// rpcRaft is the first byte sent on connections carrying the Raft protocol
+	rpcRaft byte = iota + 1
+	// rpcHaStore is the first byte sent on connections carrying our own RPC
+	rpcHaStore
+	// rpcTLS is the first byte sent on TLS connections, the TLS stream starts with one of the bytes above
+	rpcTLS
+)
+
+const (
+	rpcName        = "HaStore"
+	rpcDialTimeout = 5 * time.Second
+	rpcTimeout     = raftTimeout + 5*time.Second
+)
+
+var (
+	// ErrNoLeader when the Raft cluster has currently no known leader
+	ErrNoLeader = errors.New("No Raft leader found")
+	// ErrRPCTimeout when the Raft leader did not answer in time
+	ErrRPCTimeout = errors.New("RPC call to the Raft leader timed out")
+	// ErrApplyTimeout when a committed change is not applied locally in time
+	ErrApplyTimeout = errors.New("Timed out waiting for the local FSM")
+
+	// rpcKnownErrors are restored as is after crossing the RPC layer
+	rpcKnownErrors = []error{
+		ErrKeyNotFound,
+		ErrVersionMismatch,
+		ErrBucketNotFound,
+		ErrBucketName,
+		ErrKeyExists,
+		ErrNoLeader,
+		ErrNoVoter,
+		ErrQuorum,
+		raft.ErrNotLeader,
+		raft.ErrLeadershipLost,
+		raft.ErrRaftShutdown,
+		raft.ErrEnqueueTimeout,
+	}
+)
+
+// raftLayer implements raft.StreamLayer, it receives the Raft connections
+// accepted by our multiplexed listener on the Raft port.
+type raftLayer struct {
+	advertise net.Addr
+	tls       *tls.Config
+	connCh    chan net.Conn
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func newRaftLayer(advertise net.Addr, tlsConfig *tls.Config) *raftLayer {
+	return &raftLayer{
+		advertise: advertise,
+		tls:       tlsConfig,
+		connCh:    make(chan net.Conn),
+		closeCh:   make(chan struct{}),
+	}
+}
+
+// Accept waits for the next Raft connection
+func (l *raftLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case <-l.closeCh:
+		return nil, errors.New("Raft layer closed")
+	}
+}
+
+// Close stops accepting new Raft connections
+func (l *raftLayer) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeCh)
+	})
+	return nil
+}
+
+// Addr return the advertised Raft address
+func (l *raftLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+// Dial open a new Raft connection to another node
+func (l *raftLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return dialRPC(string(address), rpcRaft, timeout, l.tls)
+}
+
+func (l *raftLayer) handoff(conn net.Conn) {
+	select {
+	case l.connCh <- conn:
+	case <-l.closeCh:
+		conn.Close()
+	}
+}
+
+// dialRPC open a connection of "kind" to the Raft port "address", wrapped in TLS if "tlsConfig" is set
+func dialRPC(address string, kind byte, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if conn, err = dialTLS(conn, address, timeout, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := conn.Write([]byte{kind}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func dialTLS(conn net.Conn, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	if _, err := conn.Write([]byte{rpcTLS}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// rpcEndpoint exposes HaStore operations to the other nodes of the cluster.
+// Its calls are not authenticated: anyone reaching our Raft port can i.e. Apply commands
+// or change the Membership, unless Options.TLS is set without TLSConfig.SkipVerifyIncoming
+// nor AllowPlaintext (only the nodes with a certificate of our CA are accepted).
+type rpcEndpoint struct {
+	has *HaStore
+}
+
+// Apply is called by a follower to submit a JSON command to the Raft leader,
+// "reply" receives the JSON encoded applyReply of the committed entry (unauthenticated, see rpcEndpoint).
+// net/rpc only accepts exported or builtin types, so we stick to builtins.
+func (e *rpcEndpoint) Apply(cmd []byte, reply *[]byte) error {
+	res, err := e.has.raftApply(cmd)
+	if err != nil {
+		return err
+	}
+	*reply, err = json.Marshal(res)
+	return err
+}
+
+// ReadIndex is called by a follower to get the Raft index it must apply before
+// serving a linearizable read, "node" is only used for logging
+func (e *rpcEndpoint) ReadIndex(node string, index *uint64) (err error) {
+	e.has.Logger().Printf("[DEBUG] rpc: ReadIndex requested by %s", node)
+	*index, err = e.has.readIndex()
+	return
+}
+
+// rpcRead is the JSON request of a read served by the leader
+type rpcRead struct {
+	Bucket   string   `json:"bucket"`
+	Key      string   `json:"key,omitempty"`
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+func (has *HaStore) newRead(key string, patterns ...string) []byte {
+	msg, _ := json.Marshal(&rpcRead{
+		Bucket:   string(has.store.bucket),
+		Key:      key,
+		Patterns: patterns,
+	})
+	return msg
+}
+
+// Get is called by a follower to read a raw value on the leader
+func (e *rpcEndpoint) Get(req []byte, raw *json.RawMessage) error {
+	var r rpcRead
+	if err := json.Unmarshal(req, &r); err != nil {
+		return err
+	}
+	if err := e.has.raftServer.VerifyLeader().Error(); err != nil {
+		return err
+	}
+	return e.has.Bucket(r.Bucket).Get(r.Key, raw)
+}
+
+// List is called by a follower to read raw values on the leader
+func (e *rpcEndpoint) List(req []byte, raws *[]json.RawMessage) error {
+	var r rpcRead
+	if err := json.Unmarshal(req, &r); err != nil {
+		return err
+	}
+	if err := e.has.raftServer.VerifyLeader().Error(); err != nil {
+		return err
+	}
+	return e.has.Bucket(r.Bucket).List(raws, r.Patterns...)
+}
+
+func (has *HaStore) initRPC() error {
+	has.rpcServer = rpc.NewServer()
+	has.rpcClients = make(map[string]*rpc.Client)
+	return has.rpcServer.RegisterName(rpcName, &rpcEndpoint{has})
+}
+
+// listen accepts every connection on the Raft port and dispatches it
+// to Raft or to our RPC server thanks its first byte
+func (has *HaStore) listen(list net.Listener) {
+	for {
+		conn, err := list.Accept()
+		if err != nil {
+			has.Logger().Printf("[DEBUG] rpc: Listener stopped > %v", err)
+			return
+		}
+		go has.handleConn(conn)
+	}
+}
+
+func (has *HaStore) handleConn(conn net.Conn) {
+	kind, err := readKind(conn)
+	if err != nil {
+		has.Logger().Printf("[ERR] rpc: Failed to read connection type > %v", err)
+		conn.Close()
+		return
+	}
+
+	if kind == rpcTLS && has.tlsServer != nil {
+		tlsConn := tls.Server(conn, has.tlsServer)
+		tlsConn.SetDeadline(time.Now().Add(rpcDialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			has.Logger().Printf("[ERR] rpc: TLS handshake with %s failed > %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+		if kind, err = readKind(conn); err != nil {
+			has.Logger().Printf("[ERR] rpc: Failed to read connection type > %v", err)
+			conn.Close()
+			return
+		}
+	} else if has.tlsRequired {
+		has.Logger().Printf("[ERR] rpc: Plaintext connection from %s rejected, TLS is required", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	switch kind {
+	case rpcRaft:
+		has.raftLayer.handoff(conn)
+	case rpcHaStore:
+		has.rpcServer.ServeConn(conn)
+	default:
+		has.Logger().Printf("[ERR] rpc: Unrecognized connection type %d from %s", kind, conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// readKind reads the first byte of a connection
+func readKind(conn net.Conn) (byte, error) {
+	kind := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(rpcDialTimeout))
+	if _, err := io.ReadFull(conn, kind); err != nil {
+		return 0, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return kind[0], nil
+}
+
+// rpcLeader call the "method" of our RPC endpoint on the current Raft leader
+func (has *HaStore) rpcLeader(method string, args, reply interface{}) error {
+	leader := string(has.raftServer.Leader())
+	if leader == "" {
+		return ErrNoLeader
+	}
+	return has.rpcCall(leader, method, args, reply, rpcTimeout)
+}
+
+// rpcCall call the "method" of our RPC endpoint on the node listening on the Raft "address"
+func (has *HaStore) rpcCall(address, method string, args, reply interface{}, timeout time.Duration) error {
+	client, err := has.rpcClient(address)
+	if err != nil {
+		return err
+	}
+
+	call := client.Go(rpcName+"."+method, args, reply, nil)
+	select {
+	case <-call.Done:
+	case <-time.After(timeout):
+		has.rpcDrop(address, client)
+		return ErrRPCTimeout
+	}
+
+	if call.Error != nil {
+		if _, ok := call.Error.(rpc.ServerError); !ok {
+			has.rpcDrop(address, client)
+		}
+		return rpcError(call.Error)
+	}
+	return nil
+}
+
+// rpcClient return the cached client of "address", or dial it. We dial without holding rpcMutex,
+// so an unreachable node does not block the calls to the other nodes.
+func (has *HaStore) rpcClient(address string) (*rpc.Client, error) {
+	has.rpcMutex.Lock()
+	client, ok := has.rpcClients[address]
+	has.rpcMutex.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	conn, err := dialRPC(address, rpcHaStore, rpcDialTimeout, has.tlsClient)
+	if err != nil {
+		return nil, err
+	}
+	client = rpc.NewClient(conn)
+
+	has.rpcMutex.Lock()
+	defer has.rpcMutex.Unlock()
+	if cached, ok := has.rpcClients[address]; ok {
+		// dialed meanwhile by another call
+		client.Close()
+		return cached, nil
+	}
+	has.rpcClients[address] = client
+	return client, nil
+}
+
+func (has *HaStore) rpcDrop(address string, client *rpc.Client) {
+	has.rpcMutex.Lock()
+	defer has.rpcMutex.Unlock()
+
+	if has.rpcClients[address] == client {
+		delete(has.rpcClients, address)
+	}
+	client.Close()
+}
+
+// rpcError restore our well known errors, net/rpc only transports their message
+func rpcError(err error) error {
+	if srvErr, ok := err.(rpc.ServerError); ok {
+		return knownError(string(srvErr))
+	}
+	return err
+}
+
+// knownError return the well known error with the message "msg" or a new error
+func knownError(msg string) error {
+	for _, known := range rpcKnownErrors {
+		if msg == known.Error() {
+			return known
+		}
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,180 @@
+package habolt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	serfTagCluster = "cluster"
+	serfTagAuth    = "auth"
+
+	// maxRejectedJoins bounds the rejected joins we remember, the oldest is forgotten first
+	maxRejectedJoins = 64
+)
+
+// RejectedJoin is a node of the Serf cluster the leader refused to add to the Raft cluster
+type RejectedJoin struct {
+	// Node is the Serf name of the node (its Serf address)
+	Node string
+	// Cluster is the cluster name it advertises
+	Cluster string
+	Reason  string
+	Time    time.Time
+}
+
+// joinAuth is the join policy of the cluster: the nodes must advertise our cluster name
+// and the HMAC by the shared token of their name and the Raft identity of their tags
+type joinAuth struct {
+	cluster  string
+	token    []byte
+	mutex    sync.Mutex
+	rejected map[string]*RejectedJoin
+}
+
+func newJoinAuth(cluster, token string) *joinAuth {
+	a := &joinAuth{cluster: cluster, rejected: make(map[string]*RejectedJoin)}
+	if token != "" {
+		a.token = []byte(token)
+	}
+	return a
+}
+
+// sign return the HMAC-SHA256 by the token of the node name "node" and of its tags trusted
+// by the leader (cluster name, Raft ID and address), hex encoded. The signature can't be
+// reused by another node claiming the same name with another Raft address.
+func (a *joinAuth) sign(node string, tags map[string]string) string {
+	mac := hmac.New(sha256.New, a.token)
+	for _, field := range []string{tags[serfTagCluster], node, tags[serfTagID], tags[serfTagRaft]} {
+		mac.Write([]byte(field))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// tags adds our cluster name and signature to the Serf tags "tags", once our Raft identity is set
+func (a *joinAuth) tags(node string, tags map[string]string) {
+	if a.cluster != "" {
+		tags[serfTagCluster] = a.cluster
+	}
+	if a.token != nil {
+		tags[serfTagAuth] = a.sign(node, tags)
+	}
+}
+
+// check return the reason to reject the member, an empty string if it is allowed to join
+func (a *joinAuth) check(member serf.Member) string {
+	if a.cluster != "" && member.Tags[serfTagCluster] != a.cluster {
+		return "cluster name mismatch"
+	}
+	if a.token != nil && !hmac.Equal([]byte(member.Tags[serfTagAuth]), []byte(a.sign(member.Name, member.Tags))) {
+		return "invalid auth token"
+	}
+	return ""
+}
+
+// allowed checks the member, a rejected one is recorded until it joins with a valid auth
+// (only the maxRejectedJoins most recent ones, the names are chosen by the nodes)
+func (a *joinAuth) allowed(member serf.Member) (bool, string) {
+	reason := a.check(member)
+	if reason == "" {
+		a.mutex.Lock()
+		delete(a.rejected, member.Name)
+		a.mutex.Unlock()
+		return true, ""
+	}
+	a.reject(member.Name, member.Tags[serfTagCluster], reason)
+	return false, reason
+}
+
+// reject records the rejected join of "node", the oldest one is dropped beyond maxRejectedJoins
+func (a *joinAuth) reject(node, cluster, reason string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, ok := a.rejected[node]; !ok && len(a.rejected) >= maxRejectedJoins {
+		var oldest *RejectedJoin
+		for _, r := range a.rejected {
+			if oldest == nil || r.Time.Before(oldest.Time) {
+				oldest = r
+			}
+		}
+		delete(a.rejected, oldest.Node)
+	}
+	a.rejected[node] = &RejectedJoin{
+		Node:    node,
+		Cluster: cluster,
+		Reason:  reason,
+		Time:    time.Now(),
+	}
+}
+
+// enabled return true if there is a join policy
+func (a *joinAuth) enabled() bool {
+	return a.cluster != "" || a.token != nil
+}
+
+// report return a copy of the rejected joins, the most recent first
+func (a *joinAuth) report() []RejectedJoin {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	res := make([]RejectedJoin, 0, len(a.rejected))
+	for _, r := range a.rejected {
+		res = append(res, *r)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Time.After(res[j].Time) })
+	return res
+}
+
+// authorize checks the node "addr" against our join policy before adding it to the Raft
+// cluster outside a Serf join (i.e. AddVoter), it must be a member of our Serf cluster
+func (has *HaStore) authorize(addr *HaAddress) error {
+	if !has.joinAuth.enabled() {
+		return nil
+	}
+	name := addr.String()
+	for _, member := range has.serfServer.Members() {
+		if member.Name != name {
+			continue
+		}
+		if ok, reason := has.joinAuth.allowed(member); !ok {
+			return fmt.Errorf("Node %s rejected by the join policy: %s", name, reason)
+		}
+		return nil
+	}
+	return fmt.Errorf("Node %s rejected by the join policy: not a member of the Serf cluster", name)
+}
+
+// RejectedJoins is called by a follower to retreive the joins rejected by the leader
+func (e *rpcEndpoint) RejectedJoins(node string, reply *[]byte) error {
+	if e.has.raftServer.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+	var err error
+	*reply, err = json.Marshal(e.has.joinAuth.report())
+	return err
+}
+
+// RejectedJoins return the nodes the leader refused to add to the Raft cluster because
+// of Options.ClusterName or Options.JoinToken, or because they have the Raft state of another
+// cluster (i.e. they bootstrapped alone), the most recent first and at most 64 of them
+// (forwarded over RPC if we are a follower)
+func (has *HaStore) RejectedJoins() ([]RejectedJoin, error) {
+	if has.raftServer.State() == raft.Leader {
+		return has.joinAuth.report(), nil
+	}
+	var raw []byte
+	if err := has.rpcLeader("RejectedJoins", has.realAddr().String(), &raw); err != nil {
+		return nil, err
+	}
+	var res []RejectedJoin
+	return res, json.Unmarshal(raw, &res)
+}
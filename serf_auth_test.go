@@ -0,0 +1,48 @@
+package habolt
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestJoinAuthSignsRaftIdentity(t *testing.T) {
+	auth := newJoinAuth("prod", "secret")
+	tags := map[string]string{serfTagID: "node1", serfTagRaft: "10.0.0.1:10001"}
+	auth.tags("10.0.0.1:10000", tags)
+	member := serf.Member{Name: "10.0.0.1:10000", Tags: tags}
+	if reason := auth.check(member); reason != "" {
+		t.Fatalf("signed member rejected: %s", reason)
+	}
+
+	for _, tag := range []string{serfTagCluster, serfTagID, serfTagRaft} {
+		forged := make(map[string]string)
+		for k, v := range tags {
+			forged[k] = v
+		}
+		forged[tag] = "forged"
+		if reason := auth.check(serf.Member{Name: member.Name, Tags: forged}); reason == "" {
+			t.Errorf("signature reused with another %s tag", tag)
+		}
+	}
+	if reason := newJoinAuth("prod", "other").check(member); reason != "invalid auth token" {
+		t.Fatalf("member signed by another token: %q", reason)
+	}
+}
+
+func TestJoinAuthRejectedBounded(t *testing.T) {
+	auth := newJoinAuth("prod", "")
+	for i := 0; i < maxRejectedJoins*2; i++ {
+		if ok, _ := auth.allowed(serf.Member{Name: fmt.Sprintf("node%d", i)}); ok {
+			t.Fatal("member without cluster name allowed")
+		}
+	}
+	report := auth.report()
+	if len(report) != maxRejectedJoins {
+		t.Fatalf("%d rejected joins kept", len(report))
+	}
+	if last := fmt.Sprintf("node%d", maxRejectedJoins*2-1); report[0].Node != last {
+		t.Fatalf("most recent rejected join %s, expected %s", report[0].Node, last)
+	}
+}
@@ -0,0 +1,95 @@
+package habolt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+)
+
+// loadKeyring return the Serf gossip keyring: the keys persisted in "keyringFile" if it exists
+// (the primary key first, as written by Serf), else "encryptKey" alone. nil if gossip is not encrypted.
+func loadKeyring(encryptKey, keyringFile string) (*memberlist.Keyring, []string, error) {
+	var keys []string
+	if keyringFile != "" {
+		data, err := ioutil.ReadFile(keyringFile)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(data, &keys); err != nil {
+				return nil, nil, fmt.Errorf("Invalid keyring file %s: %v", keyringFile, err)
+			}
+		case !os.IsNotExist(err):
+			return nil, nil, err
+		}
+	}
+	if len(keys) == 0 {
+		if encryptKey == "" {
+			return nil, nil, nil
+		}
+		keys = []string{encryptKey}
+		if keyringFile != "" {
+			data, err := json.MarshalIndent(keys, "", "  ")
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := ioutil.WriteFile(keyringFile, data, 0600); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	rawKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid gossip key: %v", err)
+		}
+		rawKeys[i] = raw
+	}
+	keyring, err := memberlist.NewKeyring(rawKeys, rawKeys[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyring, keys, nil
+}
+
+// InstallKey installs the base64 gossip key "key" on every node of the cluster,
+// the primary key is not changed: call UseKey once it is installed everywhere
+func (has *HaStore) InstallKey(key string) error {
+	return keyResponse(has.serfServer.KeyManager().InstallKey(key))
+}
+
+// UseKey makes the installed gossip key "key" the primary key of every node,
+// i.e. the one encrypting the messages
+func (has *HaStore) UseKey(key string) error {
+	return keyResponse(has.serfServer.KeyManager().UseKey(key))
+}
+
+// RemoveKey removes the gossip key "key" from every node, it can't be the primary key
+func (has *HaStore) RemoveKey(key string) error {
+	return keyResponse(has.serfServer.KeyManager().RemoveKey(key))
+}
+
+// ListKeys return the gossip keys installed in the cluster, with the number of nodes having each of them
+func (has *HaStore) ListKeys() (map[string]int, error) {
+	resp, err := has.serfServer.KeyManager().ListKeys()
+	if err := keyResponse(resp, err); err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+// keyResponse adds the messages of the nodes which failed to the error of a keyring change
+func keyResponse(resp *serf.KeyResponse, err error) error {
+	if err == nil {
+		return nil
+	}
+	if resp == nil || len(resp.Messages) == 0 {
+		return err
+	}
+	return fmt.Errorf("%v: %v", err, resp.Messages)
+}
@@ -6,6 +6,12 @@ import (
 	"github.com/hashicorp/serf/serf"
 )
 
+const (
+	serfTagRole      = "role"
+	serfRoleVoter    = "voter"
+	serfRoleNonvoter = "nonvoter"
+)
+
 func (has *HaStore) initSerf() (err error) {
 	has.serfEvents = make(chan serf.Event, 16)
 
@@ -17,32 +23,66 @@ func (has *HaStore) initSerf() (err error) {
 		memberlistConfig.AdvertisePort = int(has.Advertise.Port)
 	}
 	memberlistConfig.Logger = has.Logger()
+	memberlistConfig.Keyring = has.keyring
 
 	serfConfig := serf.DefaultConfig()
 	serfConfig.NodeName = has.realAddr().String()
+	serfConfig.Tags = has.serfTags()
 	serfConfig.EventCh = has.serfEvents
 	serfConfig.MemberlistConfig = memberlistConfig
 	serfConfig.Logger = has.Logger()
+	serfConfig.KeyringFile = has.keyringFile
 
 	has.serfServer, err = serf.Create(serfConfig)
 	return
 }
 
+// serfTags advertise our role and our Raft identity to the other nodes
+func (has *HaStore) serfTags() map[string]string {
+	role := serfRoleVoter
+	if has.nonvoter {
+		role = serfRoleNonvoter
+	}
+	tags := map[string]string{
+		serfTagRole: role,
+		serfTagID:   string(has.nodeID),
+		serfTagRaft: has.raftAdvertise.String(),
+	}
+	has.joinAuth.tags(has.realAddr().String(), tags)
+	return tags
+}
+
 func (has *HaStore) serfMemberListener(evt serf.MemberEvent) error {
 	for _, member := range evt.Members {
-		changedPeer := serfMemberToListen(member).Raft()
+		changedPeer := serfMemberToPeer(member)
 
 		var action raft.Future
 
+		if evt.EventType() != serf.EventMemberJoin && has.replaced(member) {
+			has.Logger().Printf("[INFO] HaStore: %s now uses another address, %s of %s ignored", changedPeer.ID, evt.EventType(), member.Name)
+			continue
+		}
+
 		switch evt.EventType() {
 		case serf.EventMemberJoin:
-			action = has.raftServer.AddVoter(changedPeer.raftID(), changedPeer.raftAddress(), 0, 0)
+			if ok, reason := has.joinAuth.allowed(member); !ok {
+				has.Logger().Printf("[WARN] HaStore: Join of %s rejected, %s", member.Name, reason)
+				continue
+			}
+			if err := has.admit(changedPeer, member.Name, member.Tags[serfTagCluster]); err != nil {
+				has.Logger().Printf("[WARN] HaStore: Join rejected > %v", err)
+				continue
+			}
+			action = has.addServer(changedPeer, member.Tags[serfTagRole] == serfRoleNonvoter)
 		case serf.EventMemberFailed:
-			fallthrough
+			// removed by our autopilot after a grace period, unless it comes back
+			if has.autopilot.config.DeadServerGrace < 0 {
+				action = has.removeServer(changedPeer.ID)
+			}
 		case serf.EventMemberReap:
 			fallthrough
 		case serf.EventMemberLeave:
-			action = has.raftServer.RemoveServer(changedPeer.raftID(), 0, 0)
+			action = has.removeServer(changedPeer.ID)
 		}
 
 		if action != nil {
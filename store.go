@@ -1,10 +1,12 @@
 package habolt
 
 import (
+	"context"
 	"errors"
 	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -14,6 +16,12 @@ var (
 	ErrMissingPath = errors.New("NewStaticStore missing Path")
 	// ErrKeyNotFound for a given key which does not exist
 	ErrKeyNotFound = errors.New("DB Key not found")
+	// ErrVersionMismatch when a compare-and-swap expected another version of the key
+	ErrVersionMismatch = errors.New("DB Key version mismatch")
+	// ErrKeyExists for a given key which should not exist
+	ErrKeyExists = errors.New("DB Key already exists")
+	// ErrTTL for a TTL which is not positive
+	ErrTTL = errors.New("DB Key TTL must be positive")
 )
 
 // Store interface to define useful functions
@@ -22,8 +30,17 @@ type Store interface {
 	ListRaw() (map[string]string, error)
 	List(interface{}, ...string) error
 	Get(string, interface{}) error
+	GetWithVersion(string, interface{}) (uint64, error)
 	Set(string, interface{}) error
+	SetWithTTL(string, interface{}, time.Duration) error
+	CompareAndSet(string, uint64, interface{}) error
 	Delete(string) error
+	CompareAndDelete(string, uint64) error
+	Commit(*Txn) ([]TxnResult, error)
+	Watch(context.Context, ...string) <-chan WatchEvent
+	CreateBucket(string) error
+	DropBucket(string) error
+	Buckets() ([]string, error)
 	Addresses() ([]HaAddress, error)
 	Logger() *log.Logger
 	LogLevel(int)
@@ -37,7 +54,7 @@ type Options struct {
 	// BoltDB file mode
 	FileMode os.FileMode
 
-	// Bucket to create at the beginning
+	// Bucket to create at the beginning, used by default (other buckets are reached with "Bucket(name)")
 	Bucket string
 
 	// BoltOptions contains any specific BoltDB options you might
@@ -49,6 +66,69 @@ type Options struct {
 	// with caution.
 	NoSync bool
 
+	// RaftDir is the directory where Raft keeps its log, stable store and snapshots
+	// (HaStore only), "<Path>.raft" if empty. Its content is kept across restarts so a node rejoins
+	// with its history and its NodeID, keep it with the BoltDB.
+	RaftDir string
+
+	// SnapshotCodec compresses the Raft snapshots (HaStore only), stored in RaftDir
+	// and sent to the nodes joining the cluster. Every codec can be restored.
+	SnapshotCodec SnapshotCodec
+
+	// Nonvoter makes the HaStore a read replica (advertised thanks Serf tags): it joins the Raft
+	// cluster as a non-voter, it receives every change and serves local reads, but it never votes
+	// nor becomes leader. A non-voter can't bootstrap a cluster, it has to join existing nodes.
+	Nonvoter bool
+
+	// Autopilot tunes the removal of dead servers and the promotion of new ones (HaStore only)
+	Autopilot AutopilotConfig
+
+	// TLS secures the Raft port (HaStore only), plaintext if nil
+	TLS *TLSConfig
+
+	// EncryptKey is the base64 key (16, 24 or 32 bytes) encrypting the Serf gossip (HaStore only),
+	// every node needs it to join. Plaintext if empty and there is no KeyringFile.
+	EncryptKey string
+
+	// KeyringFile persists the gossip keys (HaStore only), updated by InstallKey, UseKey and RemoveKey.
+	// If it exists it is used instead of EncryptKey, else it is created with EncryptKey.
+	KeyringFile string
+
+	// ClusterName and JoinToken are the join policy (HaStore only): the leader only adds to the Raft
+	// cluster the nodes advertising the same cluster name and signed by the same token (see RejectedJoins),
+	// whether they join thanks Serf, AddVoter/AddNonvoter, BootstrapExpect or an autopilot promotion.
+	// The signature is sent in the Serf tags, set EncryptKey to keep it private. The policy alone does not
+	// secure the cluster: anyone reaching the Raft port can send commands, set TLS to authenticate the nodes.
+	ClusterName string
+	JoinToken   string
+
+	// RaftBind is the Raft listening address (HaStore only), Serf bind address with port + 1 by default.
+	// RaftAdvertise is the Raft address advertised to the other nodes (thanks Serf tags), by default
+	// RaftBind, or our Serf advertised address with the RaftBind port if RaftBind has no IP.
+	// Their IP can be a go-sockaddr template (see NewHaStore).
+	RaftBind      *HaAddress
+	RaftAdvertise *HaAddress
+
+	// NodeID identifies the node in the Raft configuration (HaStore only), so it can change its addresses.
+	// It is persisted in RaftDir, a random one is generated if empty. A node restarted with the Raft state
+	// of a previous version keeps its Raft address as ID.
+	NodeID string
+
+	// Discovery finds the nodes to join when Start has no peers (HaStore only), i.e. FileDiscovery,
+	// DNSDiscovery or MDNSDiscovery. While we are alone in the Serf cluster without Raft state (i.e. a
+	// non-voter or a node waiting for BootstrapExpect voters), the join is retried every RetryJoinInterval
+	// (default 30s). A node which bootstrapped alone stops retrying, and the leader of another cluster
+	// refuses to add it (see HaStore.RejectedJoins): set BootstrapExpect, so the nodes started at the same
+	// time don't bootstrap separate clusters.
+	Discovery         Discovery
+	RetryJoinInterval time.Duration
+
+	// BootstrapExpect is the number of voters of a new cluster (HaStore only): instead of bootstrapping
+	// alone, a node without Raft state waits to see at least that many voters in the Serf cluster, then
+	// the one with the lowest node ID bootstraps the cluster with all of them, the others wait for its logs.
+	// Every voter must use the same value.
+	BootstrapExpect int
+
 	// Where our default Logger will output logs
 	LogOutput io.Writer
 
@@ -0,0 +1,124 @@
+package habolt
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// ErrBucketNotFound for a given bucket which does not exist
+	ErrBucketNotFound = errors.New("DB Bucket not found")
+	// ErrBucketName for an empty or reserved bucket name, or to drop the default bucket
+	ErrBucketName = errors.New("DB Bucket name not allowed")
+)
+
+// dataBucket return our bucket in the transaction
+func (s *StaticStore) dataBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	bucket := tx.Bucket(s.bucket)
+	if bucket == nil {
+		return nil, ErrBucketNotFound
+	}
+	return bucket, nil
+}
+
+func validBucket(name string) bool {
+	return name != "" && !strings.HasPrefix(name, reservedPrefix)
+}
+
+// Bucket return a StaticStore using the bucket "name" of the same BoltDB,
+// the bucket has to be created first (see CreateBucket).
+// Closing the returned StaticStore closes the whole BoltDB.
+func (s *StaticStore) Bucket(name string) *StaticStore {
+	bucket := *s
+	bucket.bucket = []byte(name)
+	bucket.metaBucket = []byte(metaBucketPrefix + name)
+	bucket.expireBucket = []byte(expireBucketPrefix + name)
+	return &bucket
+}
+
+// CreateBucket creates the bucket "name" if it does not exist yet
+func (s *StaticStore) CreateBucket(name string) error {
+	if !validBucket(name) {
+		return ErrBucketName
+	}
+	tx, err := s.conn.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucketIfNotExists([]byte(metaBucketPrefix + name)); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucketIfNotExists([]byte(expireBucketPrefix + name)); err != nil {
+		return err
+	}
+	return s.commit(tx)
+}
+
+// DropBucket deletes the bucket "name" and all its keys, the default bucket can't be dropped
+func (s *StaticStore) DropBucket(name string) error {
+	if !validBucket(name) || name == string(s.rootBucket) {
+		return ErrBucketName
+	}
+	tx, err := s.conn.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.DeleteBucket([]byte(name)); err != nil {
+		if err == bolt.ErrBucketNotFound {
+			return ErrBucketNotFound
+		}
+		return err
+	}
+	if err := tx.DeleteBucket([]byte(metaBucketPrefix + name)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	if err := tx.DeleteBucket([]byte(expireBucketPrefix + name)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return s.commit(tx)
+}
+
+// Buckets return the name of every bucket of our BoltDB
+func (s *StaticStore) Buckets() ([]string, error) {
+	tx, err := s.conn.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res := make([]string, 0)
+	err = tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if validBucket(string(name)) {
+			res = append(res, string(name))
+		}
+		return nil
+	})
+	return res, err
+}
+
+// dropBuckets deletes every top-level bucket of the transaction
+func dropBuckets(tx *bolt.Tx) error {
+	var names [][]byte
+	err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		names = append(names, append([]byte(nil), name...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package habolt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	memberVoter    = "voter"
+	memberNonvoter = "nonvoter"
+	memberDemote   = "demote"
+	memberRemove   = "remove"
+	memberTransfer = "transfer"
+)
+
+// ErrNoVoter when the leadership can't be transferred, there is no other voter
+var ErrNoVoter = errors.New("No other Raft voter found")
+
+// rpcMembership is the JSON request of a membership change done by the leader
+type rpcMembership struct {
+	Op   string `json:"op"`
+	Addr string `json:"addr,omitempty"`
+}
+
+// Membership is called by a follower to change the Raft configuration on the leader,
+// the nodes added must pass our join policy (unauthenticated, see rpcEndpoint)
+func (e *rpcEndpoint) Membership(req []byte, index *uint64) error {
+	var r rpcMembership
+	if err := json.Unmarshal(req, &r); err != nil {
+		return err
+	}
+	var (
+		addr *HaAddress
+		err  error
+	)
+	if r.Addr != "" {
+		if addr, err = NewListen(r.Addr); err != nil {
+			return err
+		}
+	}
+	*index, err = e.has.membership(r.Op, addr)
+	return err
+}
+
+// AddVoter adds the node "addr" (its Serf address, as given to NewHaStore) to the Raft
+// configuration as a voter, or promotes it if it is a non-voter
+func (has *HaStore) AddVoter(addr *HaAddress) error {
+	return has.changeMembership(memberVoter, addr)
+}
+
+// AddNonvoter adds the node "addr" to the Raft configuration as a non-voter,
+// it receives every change but it does not vote nor become leader (read replica).
+// Like DemoteVoter, it is not promoted by the current leader.
+func (has *HaStore) AddNonvoter(addr *HaAddress) error {
+	return has.changeMembership(memberNonvoter, addr)
+}
+
+// DemoteVoter keeps the node "addr" in the Raft configuration as a non-voter,
+// ErrQuorum is returned if the other voters are not enough healthy to keep a quorum.
+// Note a new leader promotes it again if it advertises the voter role, a node started
+// with Options.Nonvoter stays a non-voter.
+func (has *HaStore) DemoteVoter(addr *HaAddress) error {
+	return has.changeMembership(memberDemote, addr)
+}
+
+// RemoveServer removes the node "addr" from the Raft configuration, i.e. a dead node.
+// Note a node still in the Serf cluster is added back (with its role) when it joins again.
+// ErrQuorum is returned if the other voters are not enough healthy to keep a quorum.
+func (has *HaStore) RemoveServer(addr *HaAddress) error {
+	return has.changeMembership(memberRemove, addr)
+}
+
+// TransferLeadership makes another voter the leader, i.e. before a maintenance of the leader.
+// This version of Raft has no leadership transfer: the leader demotes itself, which forces
+// an election between the other voters, then the new leader adds it back as a voter.
+func (has *HaStore) TransferLeadership() error {
+	return has.changeMembership(memberTransfer, nil)
+}
+
+// changeMembership is done by the leader, forwarded over RPC if we are a follower
+func (has *HaStore) changeMembership(op string, addr *HaAddress) error {
+	if has.raftServer.State() == raft.Leader {
+		_, err := has.membership(op, addr)
+		return err
+	}
+	req := &rpcMembership{Op: op}
+	if addr != nil {
+		req.Addr = addr.String()
+	}
+	msg, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var index uint64
+	return has.rpcLeader("Membership", msg, &index)
+}
+
+// membership applies the change to the Raft configuration and return its log index, leader only
+func (has *HaStore) membership(op string, addr *HaAddress) (uint64, error) {
+	if op == memberTransfer {
+		return 0, has.transferLeadership()
+	}
+	if addr == nil {
+		return 0, fmt.Errorf("Missing node address for membership op %s", op)
+	}
+	if op == memberVoter || op == memberNonvoter {
+		if err := has.authorize(addr); err != nil {
+			return 0, err
+		}
+	}
+	peer := has.lookupPeer(addr)
+	if op == memberVoter || op == memberNonvoter {
+		if err := has.admit(peer, addr.String(), ""); err != nil {
+			return 0, err
+		}
+	}
+	has.autopilot.setDemoted(peer.ID, op == memberDemote || op == memberNonvoter)
+
+	if op == memberDemote || op == memberRemove {
+		configFuture := has.raftServer.GetConfiguration()
+		if err := configFuture.Error(); err != nil {
+			return 0, err
+		}
+		if err := has.quorumSafe(configFuture.Configuration().Servers, peer.ID); err != nil {
+			return 0, err
+		}
+	}
+
+	var future raft.IndexFuture
+	switch op {
+	case memberVoter:
+		future = has.raftServer.AddVoter(peer.ID, peer.Address, 0, raftTimeout)
+	case memberNonvoter:
+		future = has.raftServer.AddNonvoter(peer.ID, peer.Address, 0, raftTimeout)
+	case memberDemote:
+		future = has.raftServer.DemoteVoter(peer.ID, 0, raftTimeout)
+	case memberRemove:
+		future = has.raftServer.RemoveServer(peer.ID, 0, raftTimeout)
+	default:
+		return 0, fmt.Errorf("Unrecognized membership op %s", op)
+	}
+	if err := future.Error(); err != nil {
+		return 0, err
+	}
+	has.Logger().Printf("[INFO] HaStore: Membership %s of %s (%s)", op, peer.ID, peer.Address)
+	return future.Index(), nil
+}
+
+// transferLeadership steps down and asks the new leader to add us back as a voter
+func (has *HaStore) transferLeadership() error {
+	if err := has.stepDown(context.Background()); err != nil {
+		return err
+	}
+	msg, err := json.Marshal(&rpcMembership{Op: memberVoter, Addr: has.realAddr().String()})
+	if err != nil {
+		return err
+	}
+	var index uint64
+	return has.rpcLeader("Membership", msg, &index)
+}
+
+// stepDown demotes ourself and waits for the new leader, until "ctx" is done
+func (has *HaStore) stepDown(ctx context.Context) error {
+	self := has.nodeID
+	configFuture := has.raftServer.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	voters := 0
+	for _, server := range configFuture.Configuration().Servers {
+		if server.Suffrage == raft.Voter && server.ID != self {
+			voters++
+		}
+	}
+	if voters == 0 {
+		return ErrNoVoter
+	}
+
+	demoted := make(chan error, 1)
+	go func() {
+		demoted <- has.raftServer.DemoteVoter(self, 0, raftTimeout).Error()
+	}()
+	select {
+	case err := <-demoted:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := has.waitLeader(ctx, raftTimeout); err != nil {
+		return err
+	}
+	has.Logger().Printf("[INFO] HaStore: Leadership transferred to %s", has.raftServer.Leader())
+	return nil
+}
+
+// waitLeader blocks until another node is the Raft leader
+func (has *HaStore) waitLeader(ctx context.Context, timeout time.Duration) error {
+	self := has.raftAdvertise.raftAddress()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case <-ticker.C:
+			if leader := has.raftServer.Leader(); leader != "" && leader != self {
+				return nil
+			}
+		case <-deadline:
+			return ErrNoLeader
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// IsLeader return true if we are the Raft leader
+func (has *HaStore) IsLeader() bool {
+	return has.raftServer.State() == raft.Leader
+}
+
+// Leader return the Raft address of the current leader (like Addresses), ErrNoLeader if there is none
+func (has *HaStore) Leader() (*HaAddress, error) {
+	leader := has.raftServer.Leader()
+	if leader == "" {
+		return nil, ErrNoLeader
+	}
+	return NewListen(string(leader))
+}
+
+// WatchLeader return a channel receiving true when we gain the Raft leadership and false when we lose it,
+// starting with our current state, i.e. to run leader only jobs. Only the last state is kept if it is
+// not read in time. The channel is closed when "ctx" is done or on Shutdown.
+func (has *HaStore) WatchLeader(ctx context.Context) <-chan bool {
+	ch := make(chan bool, 1)
+	has.leaderMutex.Lock()
+	ch <- has.leading
+	has.leaderWatch[ch] = struct{}{}
+	has.leaderMutex.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-has.leaderDone:
+		}
+		has.unwatchLeader(ch)
+	}()
+	return ch
+}
+
+func (has *HaStore) unwatchLeader(ch chan bool) {
+	has.leaderMutex.Lock()
+	defer has.leaderMutex.Unlock()
+	if _, ok := has.leaderWatch[ch]; ok {
+		delete(has.leaderWatch, ch)
+		close(ch)
+	}
+}
+
+// leaderLoop receives the leadership changes from Raft and sends them to our watchers,
+// it runs until Raft is shut down (Raft blocks until we read its notification)
+func (has *HaStore) leaderLoop() {
+	for {
+		select {
+		case leader := <-has.leaderNotify:
+			has.Logger().Printf("[INFO] HaStore: Leadership changed, leader = %v", leader)
+			has.leaderMutex.Lock()
+			has.leading = leader
+			for ch := range has.leaderWatch {
+				select {
+				case ch <- leader:
+				default:
+					// replace the state not read yet
+					select {
+					case <-ch:
+					default:
+					}
+					ch <- leader
+				}
+			}
+			has.leaderMutex.Unlock()
+		case <-has.leaderDone:
+			return
+		}
+	}
+}
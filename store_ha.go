@@ -1,66 +1,256 @@
 package habolt
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
 	"github.com/hashicorp/serf/serf"
 )
 
+// ErrNonvoterBootstrap when a non-voter is started without any node to join
+var ErrNonvoterBootstrap = errors.New("A non-voter can't bootstrap a Raft cluster")
+
 const (
 	retainSnapshotCount = 2
 	raftStoreFileName   = "raft.db"
 	raftTimeout         = 10 * time.Second
-	raftUserEventName   = "us_hastore_apply"
+	expireInterval      = time.Second
+	expireBatchSize     = 1000
+)
+
+// ReadConsistency defines how up-to-date a read on HaStore must be
+type ReadConsistency int
+
+const (
+	// ReadStale reads the local Store, it could return old data on a follower (default for Get/List)
+	ReadStale ReadConsistency = iota
+	// ReadLeader reads are served by the leader once it verified its leadership
+	ReadLeader
+	// ReadLinearizable reads wait until the local Store applied every change
+	// committed before the read (thanks a Raft barrier on the leader)
+	ReadLinearizable
 )
 
 // HaStore is a wrapper of our StaticStore with Serf & Raft
 // running to replicate all data between nodes.
 type HaStore struct {
+	*haNode
+	store     *StaticStore
+	Bind      *HaAddress
+	Advertise *HaAddress
+}
+
+// haNode contains the Serf & Raft servers of a HaStore, shared by all its buckets
+type haNode struct {
+	// appliedIndex is the last Raft log index applied by our FSM and restoreIndex the index
+	// of the snapshot being restored, first in the struct to be 64-bit aligned for atomic operations
+	appliedIndex uint64
+	restoreIndex uint64
+
 	mutex      sync.Mutex
-	store      Store
-	Bind       *HaAddress
-	Advertise  *HaAddress
+	raftDir    string
+	raftState  bool
+	snapCodec  SnapshotCodec
+	nonvoter   bool
+	autopilot  *autopilot
+	joinAuth   *joinAuth
+	raftStore  *raftboltdb.BoltStore
 	raftServer *raft.Raft
+	raftLayer  *raftLayer
 	serfServer *serf.Serf
 	serfEvents chan serf.Event
+	listener   net.Listener
+	rpcServer  *rpc.Server
+	rpcClients map[string]*rpc.Client
+	rpcMutex   sync.Mutex
+
+	// nodeID identifies us in the Raft configuration, whatever our addresses
+	nodeID        raft.ServerID
+	raftBind      *HaAddress
+	raftAdvertise *HaAddress
+
+	// cluster identifies our Raft cluster, see clusterID
+	cluster      string
+	clusterMutex sync.Mutex
+
+	discovery         Discovery
+	retryJoinInterval time.Duration
+	bootstrapExpect   int
+
+	tlsServer   *tls.Config
+	tlsClient   *tls.Config
+	tlsRequired bool
+
+	keyring     *memberlist.Keyring
+	keyringFile string
+
+	leaderNotify chan bool
+	leaderWatch  map[chan bool]struct{}
+	leading      bool
+	leaderMutex  sync.Mutex
+	leaderDone   chan struct{}
+
+	errorCh      chan error
+	loopDone     chan struct{}
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
 }
 
 // NewHaStore create a new HaStore, "bindAddr" will be the local IP:PORT listening address
 // "advAddr" will be the advertised IP:PORT address (for NAT Traversal)
+// Their IP can be a go-sockaddr template, i.e. NewAddress("{{ GetPrivateIP }}", 10001)
 func NewHaStore(bindAddr, advAddr *HaAddress, opts *Options) (*HaStore, error) {
+	bindAddr, err := bindAddr.resolve()
+	if err != nil {
+		return nil, err
+	}
+	if advAddr, err = advAddr.resolve(); err != nil {
+		return nil, err
+	}
 	db, err := NewStaticStore(opts)
 	if err != nil {
 		return nil, err
 	}
 	obj := &HaStore{
+		haNode: &haNode{
+			raftDir:    opts.RaftDir,
+			snapCodec:  opts.SnapshotCodec,
+			nonvoter:   opts.Nonvoter,
+			autopilot:  newAutopilot(opts.Autopilot),
+			joinAuth:   newJoinAuth(opts.ClusterName, opts.JoinToken),
+			errorCh:    make(chan error, 16),
+			shutdownCh: make(chan struct{}),
+
+			discovery:         opts.Discovery,
+			retryJoinInterval: opts.RetryJoinInterval,
+			bootstrapExpect:   opts.BootstrapExpect,
+
+			leaderNotify: make(chan bool, 1),
+			leaderWatch:  make(map[chan bool]struct{}),
+			leaderDone:   make(chan struct{}),
+		},
 		store:     db,
 		Bind:      bindAddr,
 		Advertise: advAddr,
 	}
 
+	if obj.retryJoinInterval <= 0 {
+		obj.retryJoinInterval = defaultRetryJoinInterval
+	}
+
+	if err := obj.initIdentity(opts); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if opts.TLS != nil {
+		if obj.tlsServer, obj.tlsClient, err = opts.TLS.load(); err != nil {
+			db.Close()
+			return nil, err
+		}
+		obj.tlsRequired = !opts.TLS.AllowPlaintext
+	}
+
+	var keys []string
+	if obj.keyring, keys, err = loadKeyring(opts.EncryptKey, opts.KeyringFile); err != nil {
+		db.Close()
+		return nil, err
+	}
+	obj.keyringFile = opts.KeyringFile
+	if opts.EncryptKey != "" && keys[0] != opts.EncryptKey {
+		obj.store.Logger().Printf("[WARN] HaStore: EncryptKey is not the primary key of the keyring file %s, ignored", opts.KeyringFile)
+	}
+
 	obj.store.Logger().Printf(`[INFO] Starting HaStore servers:
 	- Serf listening on %s (%s)
-	- Raft listening on %s (%s)`,
+	- Raft listening on %s (%s), node ID %s`,
 		bindAddr, obj.realAddr(),
-		bindAddr.Raft(), obj.realAddr().Raft(),
+		obj.raftBind, obj.raftAdvertise, obj.nodeID,
 	)
 
 	if err := obj.initSerf(); err != nil {
+		obj.abort()
 		return nil, err
 	}
 	if err := obj.initRaft(); err != nil {
+		obj.abort()
 		return nil, err
 	}
 	return obj, nil
 }
 
-// Close to close the embeded Store
+// abort closes what NewHaStore started before failing, so the ports and the BoltDB can be reused
+func (has *HaStore) abort() {
+	if has.serfServer != nil {
+		has.serfServer.Shutdown()
+	}
+	if has.listener != nil {
+		has.listener.Close()
+	}
+	if has.raftLayer != nil {
+		has.raftLayer.Close()
+	}
+	if has.raftStore != nil {
+		has.raftStore.Close()
+	}
+	has.store.Close()
+}
+
+// Bucket return a HaStore using the bucket "name", sharing the Serf & Raft servers of "has".
+// The bucket has to be created first (see CreateBucket).
+func (has *HaStore) Bucket(name string) *HaStore {
+	return &HaStore{
+		haNode:    has.haNode,
+		store:     has.store.Bucket(name),
+		Bind:      has.Bind,
+		Advertise: has.Advertise,
+	}
+}
+
+// CreateBucket creates the bucket "name" on every node if it does not exist yet
+func (has *HaStore) CreateBucket(name string) error {
+	if !validBucket(name) {
+		return ErrBucketName
+	}
+	c := has.newCommand("mkbucket", "")
+	c.Bucket = name
+	_, err := has.apply(c)
+	return err
+}
+
+// DropBucket deletes the bucket "name" and all its keys on every node
+func (has *HaStore) DropBucket(name string) error {
+	if !validBucket(name) {
+		return ErrBucketName
+	}
+	c := has.newCommand("rmbucket", "")
+	c.Bucket = name
+	_, err := has.apply(c)
+	return err
+}
+
+// Buckets return the name of every bucket in our local Store
+func (has *HaStore) Buckets() ([]string, error) {
+	return has.store.Buckets()
+}
+
+// Close shutdowns the HaStore (see Shutdown) and closes the embeded Store
 func (has *HaStore) Close() error {
-	return has.store.Close()
+	return has.Shutdown(context.Background())
 }
 
 // Logger return the logger of our Store (to implements Store interface)
@@ -84,43 +274,183 @@ func (has *HaStore) isAdv() bool {
 	return has.Advertise != nil && has.Advertise.Address != ""
 }
 
-// Start run the Serf & Raft communication and event handlers
+// Start join or bootstrap the cluster, then run the Serf event handlers in background
 // You could pass some node's addresses "ip:port" in parameters to join an existing cluster
-func (has *HaStore) Start(peers ...string) error {
-	if len(peers) > 0 {
-		if _, err := has.serfServer.Join(peers, false); err != nil {
+// A node restarted with an existing Raft state never bootstraps a new cluster
+// Without peers, the nodes found by Options.Discovery are joined, a new cluster is bootstrapped
+// if none of them answers (nodes started at the same time may bootstrap separate clusters, see
+// Options.BootstrapExpect). With Options.Discovery, the join is retried in background while we
+// are alone in the Serf cluster without Raft state.
+// The event loop stops when "ctx" is done or on Shutdown, its failures are sent to Errors()
+func (has *HaStore) Start(ctx context.Context, peers ...string) error {
+	discovered := false
+	if has.discovery != nil {
+		var err error
+		if ctx, err = has.startDiscovery(ctx); err != nil {
 			return err
 		}
-	} else {
-		if err := has.raftBootstrap(peers...); err != nil {
+		if len(peers) == 0 {
+			peers, discovered = has.discover(ctx), true
+		}
+	}
+
+	joined := false
+	if len(peers) > 0 {
+		if _, err := has.serfServer.Join(peers, false); err == nil {
+			joined = true
+		} else if !discovered {
 			return err
+		} else {
+			has.Logger().Printf("[WARN] HaStore: Join of the discovered nodes %v failed > %v", peers, err)
 		}
 	}
+	if !joined && !has.raftState {
+		switch {
+		case has.nonvoter:
+			if !discovered {
+				return ErrNonvoterBootstrap
+			}
+		case has.bootstrapExpect > 0:
+			// bootstrapped by the event loop once the expected voters are seen
+		default:
+			if discovered {
+				has.Logger().Printf("[WARN] HaStore: No discovered node answered, bootstrapping alone (see Options.BootstrapExpect)")
+			}
+			if err := has.raftBootstrap(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if has.discovery != nil && has.raftServer.LastIndex() == 0 {
+		go has.retryJoin(ctx)
+	}
+	has.loopDone = make(chan struct{})
+	go has.eventLoop(ctx)
+	return nil
+}
 
+func (has *HaStore) eventLoop(ctx context.Context) {
+	defer close(has.loopDone)
+	expireTicker := time.NewTicker(expireInterval)
+	defer expireTicker.Stop()
+	autopilotTicker := time.NewTicker(autopilotInterval)
+	defer autopilotTicker.Stop()
+	// waiting for Options.BootstrapExpect voters, then for a leader adding the other members
+	expecting := has.bootstrapExpect > 0 && !has.raftState && !has.nonvoter
+	joining := false
+	bootstrap := func() {
+		if expecting {
+			expecting = !has.expectBootstrap()
+			joining = !expecting
+		}
+		if joining {
+			joining = !has.joinMembers()
+		}
+	}
 	for {
 		select {
+		case <-expireTicker.C:
+			has.expireKeys()
+		case <-autopilotTicker.C:
+			bootstrap()
+			has.learnClusterID()
+			has.autopilotRun()
 		case ev := <-has.serfEvents:
+			bootstrap()
 			leader := has.raftServer.VerifyLeader()
 			if leader.Error() == nil {
-				switch evt := ev.(type) {
-				case serf.MemberEvent:
+				if evt, ok := ev.(serf.MemberEvent); ok {
 					if err := has.serfMemberListener(evt); err != nil {
-						return err
-					}
-				case serf.UserEvent:
-					if evt.Name == raftUserEventName {
-						fut := has.raftServer.Apply(evt.Payload, raftTimeout)
-						if err := fut.Error(); err != nil {
-							has.store.Logger().Printf("[DEBUG] raft: Error apply > %v", err)
-						}
+						has.reportError(err)
 					}
 				}
 			}
+		case <-ctx.Done():
+			return
+		case <-has.shutdownCh:
+			return
 		}
 	}
 }
 
-// Addresses retrieved the list of addresses in our Raft cluster
+// Errors return the channel where the event loop failures are sent,
+// errors are dropped (but logged) if nobody reads them
+func (has *HaStore) Errors() <-chan error {
+	return has.errorCh
+}
+
+func (has *HaStore) reportError(err error) {
+	has.Logger().Printf("[ERR] HaStore: Event loop > %v", err)
+	select {
+	case has.errorCh <- err:
+	default:
+	}
+}
+
+// Shutdown stops the event loop, leaves the Serf cluster gracefully, gives up the leadership
+// if we are the leader, stops Raft and its transport, then closes our Store.
+// Graceful steps are cut short once "ctx" is done, the node is always stopped.
+func (has *HaStore) Shutdown(ctx context.Context) error {
+	var err error
+	has.shutdownOnce.Do(func() {
+		close(has.shutdownCh)
+		if has.loopDone != nil {
+			<-has.loopDone
+		}
+
+		if err := has.leave(ctx); err != nil {
+			has.Logger().Printf("[WARN] HaStore: Graceful leave failed > %v", err)
+		}
+		err = has.stop()
+	})
+	return err
+}
+
+// leave steps down if we are the leader, without asking to be added back (unlike TransferLeadership)
+// while the new leader still finds our identity in the Serf tags, then leaves our Serf cluster.
+// The Serf leave is skipped once "ctx" is done, so it never runs concurrently with stop.
+func (has *HaStore) leave(ctx context.Context) error {
+	if has.raftServer.State() == raft.Leader {
+		if err := has.stepDown(ctx); err != nil && err != ErrNoVoter {
+			has.Logger().Printf("[WARN] HaStore: Leadership transfer failed > %v", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return has.serfServer.Leave()
+}
+
+// stop every server and close our stores
+func (has *HaStore) stop() error {
+	var errs []string
+	collect := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	collect(has.serfServer.Shutdown())
+	collect(has.raftServer.Shutdown().Error())
+	close(has.leaderDone)
+	collect(has.listener.Close())
+	has.rpcMutex.Lock()
+	for addr, client := range has.rpcClients {
+		client.Close()
+		delete(has.rpcClients, addr)
+	}
+	has.rpcMutex.Unlock()
+	collect(has.raftStore.Close())
+	collect(has.store.Close())
+
+	if len(errs) > 0 {
+		return fmt.Errorf("HaStore shutdown: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Addresses retrieved the list of Raft addresses in our Raft cluster
 func (has *HaStore) Addresses() ([]HaAddress, error) {
 	cFuture := has.raftServer.GetConfiguration()
 	if err := cFuture.Error(); err != nil {
@@ -129,7 +459,7 @@ func (has *HaStore) Addresses() ([]HaAddress, error) {
 	members := make([]HaAddress, 0)
 	config := cFuture.Configuration()
 	for _, server := range config.Servers {
-		addr, err := NewListen(string(server.ID))
+		addr, err := NewListen(string(server.Address))
 		if err != nil {
 			return nil, err
 		}
@@ -144,6 +474,7 @@ func (has *HaStore) ListRaw() (map[string]string, error) {
 }
 
 // List retreive all values in our Store, you could filter by keys with wildcard patterns (i.e. "prefix_*")
+// Values are read from the local Store (see ListConsistent for other read consistencies)
 func (has *HaStore) List(values interface{}, patterns ...string) error {
 	has.mutex.Lock()
 	defer has.mutex.Unlock()
@@ -151,39 +482,342 @@ func (has *HaStore) List(values interface{}, patterns ...string) error {
 }
 
 // Get retreive a specific value in our Store thanks its key.
+// The value is read from the local Store (see GetConsistent for other read consistencies)
 func (has *HaStore) Get(key string, value interface{}) error {
 	has.mutex.Lock()
 	defer has.mutex.Unlock()
 	return has.store.Get(key, value)
 }
 
-// Set forward the "key"/"value" as an UserEvent to our Serf cluster
-// This event will be catched by the Leader of the Raft server to apply it everywhere
-func (has *HaStore) Set(key string, value interface{}) error {
-	c := &command{
-		Op:    "set",
-		Key:   key,
-		Value: value,
-		Addr:  has.realAddr().Raft().String(),
+// GetConsistent works like Get with the given read consistency
+func (has *HaStore) GetConsistent(consistency ReadConsistency, key string, value interface{}) error {
+	switch consistency {
+	case ReadLeader:
+		if has.raftServer.State() != raft.Leader {
+			var raw json.RawMessage
+			if err := has.rpcLeader("Get", has.newRead(key), &raw); err != nil {
+				return err
+			}
+			return json.Unmarshal(raw, value)
+		}
+		if err := has.raftServer.VerifyLeader().Error(); err != nil {
+			return err
+		}
+	case ReadLinearizable:
+		if err := has.linearize(); err != nil {
+			return err
+		}
+	}
+	return has.Get(key, value)
+}
+
+// ListConsistent works like List with the given read consistency
+func (has *HaStore) ListConsistent(consistency ReadConsistency, values interface{}, patterns ...string) error {
+	switch consistency {
+	case ReadLeader:
+		if has.raftServer.State() != raft.Leader {
+			var raws []json.RawMessage
+			if err := has.rpcLeader("List", has.newRead("", patterns...), &raws); err != nil {
+				return err
+			}
+			return appendRaws(values, raws)
+		}
+		if err := has.raftServer.VerifyLeader().Error(); err != nil {
+			return err
+		}
+	case ReadLinearizable:
+		if err := has.linearize(); err != nil {
+			return err
+		}
+	}
+	return has.List(values, patterns...)
+}
+
+// linearize waits for our local Store to catch up with the leader read index
+func (has *HaStore) linearize() (err error) {
+	var index uint64
+	if has.raftServer.State() == raft.Leader {
+		index, err = has.readIndex()
+	} else {
+		err = has.rpcLeader("ReadIndex", has.realAddr().String(), &index)
 	}
-	msg, err := json.Marshal(c)
 	if err != nil {
+		return
+	}
+	return has.waitApplied(index, raftTimeout)
+}
+
+// readIndex commits a Raft barrier, once applied every previous change is in our FSM
+// so the applied index can be used as a read index by any node. Leader only.
+// Note the read index may be a barrier, a no-op or a configuration change (i.e. restored
+// thanks a snapshot), they are not applied by the FSM of the followers (see applied).
+func (has *HaStore) readIndex() (uint64, error) {
+	if err := has.raftServer.Barrier(raftTimeout).Error(); err != nil {
+		return 0, err
+	}
+	return has.AppliedIndex(), nil
+}
+
+// appendRaws "json.Unmarshal" each raw value and append it to the "values" slice pointer
+func appendRaws(values interface{}, raws []json.RawMessage) error {
+	vtype := reflect.TypeOf(values)
+	if vtype.Kind() != reflect.Ptr || vtype.Elem().Kind() != reflect.Slice {
+		return errors.New("Not a Pointer of Slice")
+	}
+	slice := reflect.ValueOf(values).Elem()
+	for _, raw := range raws {
+		value := reflect.New(slice.Type().Elem())
+		if err := json.Unmarshal(raw, value.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, value.Elem()))
+	}
+	return nil
+}
+
+// GetWithVersion works like Get and also returns the current version of the "key",
+// it could be used with CompareAndSet or CompareAndDelete.
+func (has *HaStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	has.mutex.Lock()
+	defer has.mutex.Unlock()
+	return has.store.GetWithVersion(key, value)
+}
+
+// Watch return a channel receiving every change of the keys matching the wildcard patterns,
+// events are emitted on every node when it applies the change, EventReset when it restores
+// a Raft snapshot (see StaticStore.Watch)
+func (has *HaStore) Watch(ctx context.Context, patterns ...string) <-chan WatchEvent {
+	return has.store.Watch(ctx, patterns...)
+}
+
+// Set send the "key"/"value" to the Raft leader (forwarded over RPC if we are a follower)
+// It returns once the leader has committed and applied the change, with the FSM error if any
+func (has *HaStore) Set(key string, value interface{}) error {
+	c := has.newCommand("set", key)
+	if err := c.setValue(value); err != nil {
 		return err
 	}
-	return has.serfServer.UserEvent(raftUserEventName, msg, false)
+	_, err := has.apply(c)
+	return err
 }
 
-// Delete forware the "key"/"value" as an UserEvent to our Serf cluster
-// This event will be catched by the Leader of the Raft server to apply it everywhere
+// Delete send the "key" deletion to the Raft leader (forwarded over RPC if we are a follower)
+// It returns once the leader has committed and applied the change, with the FSM error if any
 func (has *HaStore) Delete(key string) error {
-	c := &command{
-		Op:   "del",
-		Key:  key,
-		Addr: has.realAddr().Raft().String(),
+	_, err := has.apply(has.newCommand("del", key))
+	return err
+}
+
+// SetWithTTL works like Set, but the "key" expires after "ttl" (ErrTTL if not positive).
+// Expired keys are hidden from reads, then the leader deletes them everywhere.
+func (has *HaStore) SetWithTTL(key string, value interface{}, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrTTL
 	}
-	msg, err := json.Marshal(c)
+	c := has.newCommand("set", key)
+	if err := c.setValue(value); err != nil {
+		return err
+	}
+	c.Expire = time.Now().Add(ttl).UnixNano()
+	_, err := has.apply(c)
+	return err
+}
+
+// expireKeys deletes the expired keys of every bucket thanks replicated commands, leader only.
+// Only the due keys of the expiry index of each bucket are read.
+// The keys of a bucket are deleted by batches of expireBatchSize in a single command, each
+// deletion expects the key revision, so a key set again meanwhile is kept.
+func (has *HaStore) expireKeys() {
+	if has.raftServer.State() != raft.Leader {
+		return
+	}
+	buckets, err := has.store.Buckets()
 	if err != nil {
+		has.Logger().Printf("[ERR] HaStore: Failed to list buckets > %v", err)
+		return
+	}
+	now := time.Now().UnixNano()
+	for _, name := range buckets {
+		bucket := has.Bucket(name)
+		expired, err := bucket.store.listExpired(now)
+		if err != nil {
+			has.Logger().Printf("[ERR] HaStore: Failed to list expired keys of %s > %v", name, err)
+			continue
+		}
+		ops := make([]txnOp, 0, len(expired))
+		for key, revision := range expired {
+			ops = append(ops, txnOp{Op: txnDelete, Key: key, Version: revision})
+		}
+		for len(ops) > 0 {
+			n := len(ops)
+			if n > expireBatchSize {
+				n = expireBatchSize
+			}
+			c := bucket.newCommand("expire", "")
+			c.Txn = ops[:n]
+			if _, err := bucket.apply(c); err != nil {
+				has.Logger().Printf("[WARN] HaStore: Failed to expire %d keys of %s > %v", n, name, err)
+			}
+			ops = ops[n:]
+		}
+	}
+}
+
+// CompareAndSet works like Set only if the "key" is still at "version" when the leader applies it,
+// otherwise ErrVersionMismatch is returned. Version 0 means the key must not exist.
+// Like Set, the TTL of the key is removed (see SetWithTTL). A nil "value" is stored as JSON null.
+// An expired key is at version 0, even if the leader has not deleted it yet.
+func (has *HaStore) CompareAndSet(key string, version uint64, value interface{}) error {
+	c := has.newCommand("cas", key)
+	if err := c.setValue(value); err != nil {
 		return err
 	}
-	return has.serfServer.UserEvent(raftUserEventName, msg, false)
+	c.Version = version
+	// the expired keys are at version 0, at our time so every node agrees
+	c.Now = time.Now().UnixNano()
+	_, err := has.apply(c)
+	return err
+}
+
+// CompareAndDelete works like Delete only if the "key" is still at "version" when the leader applies it,
+// otherwise ErrVersionMismatch is returned. An expired key is at version 0.
+func (has *HaStore) CompareAndDelete(key string, version uint64) error {
+	c := has.newCommand("cad", key)
+	c.Version = version
+	c.Now = time.Now().UnixNano()
+	_, err := has.apply(c)
+	return err
+}
+
+// Commit applies every operation of the transaction atomically on every node, or none of them.
+// A rejected transaction returns a *TxnError, see StaticStore.Commit.
+func (has *HaStore) Commit(txn *Txn) ([]TxnResult, error) {
+	if txn.err != nil {
+		return nil, txn.err
+	}
+	c := has.newCommand("txn", "")
+	c.Txn = txn.ops
+	// the guards see the expired keys as missing, at our time so every node agrees
+	c.Now = time.Now().UnixNano()
+	reply, err := has.applyReply(c)
+	if err != nil {
+		return nil, err
+	}
+	resp := &txnResponse{}
+	if err := json.Unmarshal(reply.Response, resp); err != nil {
+		return nil, err
+	}
+	return resp.results(txn.ops)
+}
+
+// SetSync works like Set, but it also waits for the change to be applied on this node.
+// It returns the Raft log index of the change (see AppliedIndex for read-your-writes).
+func (has *HaStore) SetSync(key string, value interface{}) (uint64, error) {
+	c := has.newCommand("set", key)
+	if err := c.setValue(value); err != nil {
+		return 0, err
+	}
+	return has.applySync(c)
+}
+
+// DeleteSync works like Delete, but it also waits for the change to be applied on this node.
+// It returns the Raft log index of the change (see AppliedIndex for read-your-writes).
+func (has *HaStore) DeleteSync(key string) (uint64, error) {
+	return has.applySync(has.newCommand("del", key))
+}
+
+// AppliedIndex return the last Raft log index applied in our local Store.
+// Once it reaches an index returned by SetSync/DeleteSync, local reads include that change.
+func (has *HaStore) AppliedIndex() uint64 {
+	return atomic.LoadUint64(&has.appliedIndex)
+}
+
+// applySync submit the command and waits for our local FSM to apply it
+func (has *HaStore) applySync(c *command) (uint64, error) {
+	index, err := has.apply(c)
+	if err != nil {
+		return 0, err
+	}
+	if err := has.waitApplied(index, raftTimeout); err != nil {
+		return index, err
+	}
+	return index, nil
+}
+
+// waitApplied blocks until our FSM has applied the Raft log "index"
+func (has *HaStore) waitApplied(index uint64, timeout time.Duration) error {
+	if has.applied(index) {
+		return nil
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case <-ticker.C:
+			if has.applied(index) {
+				return nil
+			}
+		case <-deadline:
+			return ErrApplyTimeout
+		}
+	}
+}
+
+// applied return true if our FSM has applied every command up to the Raft log "index".
+// Only the commands are applied by our FSM, so once Raft applied "index" the logs
+// after our applied index must be barriers, no-ops or configuration changes.
+// A log missing from our store was compacted after a snapshot of our FSM, not a command.
+func (has *HaStore) applied(index uint64) bool {
+	applied := has.AppliedIndex()
+	if applied >= index {
+		return true
+	}
+	if has.raftServer.AppliedIndex() < index {
+		return false
+	}
+	for i := applied + 1; i <= index; i++ {
+		var l raft.Log
+		if err := has.raftStore.GetLog(i, &l); err == nil && l.Type == raft.LogCommand {
+			return false
+		}
+	}
+	return true
+}
+
+// newCommand prepare a command on our bucket
+func (has *HaStore) newCommand(op, key string) *command {
+	return &command{
+		Op:     op,
+		Bucket: string(has.store.bucket),
+		Key:    key,
+		Addr:   has.raftAdvertise.String(),
+	}
+}
+
+// apply submit the command to Raft and return its log index
+func (has *HaStore) apply(c *command) (uint64, error) {
+	reply, err := has.applyReply(c)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Index, nil
+}
+
+// applyReply submit the command to Raft, directly if we are the leader, otherwise
+// it is forwarded to the leader thanks our RPC endpoint
+func (has *HaStore) applyReply(c *command) (*applyReply, error) {
+	msg, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	if has.raftServer.State() == raft.Leader {
+		return has.raftApply(msg)
+	}
+	var raw []byte
+	if err := has.rpcLeader("Apply", msg, &raw); err != nil {
+		return nil, err
+	}
+	reply := &applyReply{}
+	return reply, json.Unmarshal(raw, reply)
 }
@@ -0,0 +1,237 @@
+package habolt
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// freePort return a port free for Serf (TCP and UDP) with the next one free for Raft
+func freePort(t *testing.T) int {
+	for i := 0; i < 10; i++ {
+		list, err := net.Listen("tcp", "[::]:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := list.Addr().(*net.TCPAddr).Port
+		list.Close()
+		if portFree(port) && portFree(port+1) {
+			return port
+		}
+	}
+	t.Fatal("no free port")
+	return 0
+}
+
+func portFree(port int) bool {
+	addr := net.JoinHostPort("::", strconv.Itoa(port))
+	list, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	list.Close()
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// newTestHaStore starts a node listening on every address (dual-stack) and advertising "ip",
+// "setup" changes its options if not nil
+func newTestHaStore(t *testing.T, ip string, setup func(*Options), peers ...string) *HaStore {
+	dir, err := ioutil.TempDir("", "habolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	port := freePort(t)
+	opts := &Options{
+		Path:      filepath.Join(dir, "test.db"),
+		LogOutput: ioutil.Discard,
+		Autopilot: AutopilotConfig{StabilizationTime: -1},
+	}
+	if setup != nil {
+		setup(opts)
+	}
+	has, err := NewHaStore(NewAddress("::", port), NewAddress(ip, port), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { has.Close() })
+	if err := has.Start(context.Background(), peers...); err != nil {
+		t.Fatal(err)
+	}
+	return has
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(20 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDualStackCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a Serf/Raft cluster")
+	}
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("no IPv6 loopback")
+	} else {
+		l.Close()
+	}
+
+	v4 := newTestHaStore(t, "127.0.0.1", nil)
+	waitFor(t, "the IPv4 node leadership", v4.IsLeader)
+	v6 := newTestHaStore(t, "::1", nil, v4.realAddr().String())
+	waitFor(t, "the IPv6 node as voter", func() bool {
+		addrs, err := v4.Addresses()
+		return err == nil && len(addrs) == 2
+	})
+	addrs, _ := v4.Addresses()
+	if raft6 := v6.raftAdvertise.String(); addrs[1].String() != raft6 {
+		t.Fatalf("Raft addresses %v, expected %s", addrs, raft6)
+	}
+
+	waitFor(t, "the leader seen by the IPv6 node", func() bool {
+		_, err := v6.Leader()
+		return err == nil
+	})
+	// written through the IPv6 follower, forwarded to the IPv4 leader over RPC
+	if _, err := v6.SetSync("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if err := v4.GetConsistent(ReadLinearizable, "key", &value); err != nil || value != "value" {
+		t.Fatalf("key = %q on the IPv4 node: %v", value, err)
+	}
+	if err := v6.GetConsistent(ReadLeader, "key", &value); err != nil || value != "value" {
+		t.Fatalf("key = %q read by the IPv6 node on the leader: %v", value, err)
+	}
+}
+
+func TestForeignStateRefused(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a Serf/Raft cluster")
+	}
+	a := newTestHaStore(t, "127.0.0.1", nil)
+	b := newTestHaStore(t, "127.0.0.1", nil)
+	waitFor(t, "the leaderships", func() bool { return a.IsLeader() && b.IsLeader() })
+	if _, err := a.SetSync("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.SetSync("b", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// both bootstrapped alone, their Serf clusters are merged
+	if _, err := b.serfServer.Join([]string{a.realAddr().String()}, false); err != nil {
+		t.Fatal(err)
+	}
+	name := b.realAddr().String()
+	waitFor(t, "the refusal of the other cluster", func() bool {
+		rejected, err := a.RejectedJoins()
+		return err == nil && len(rejected) == 1 && rejected[0].Node == name
+	})
+	if addrs, err := a.Addresses(); err != nil || len(addrs) != 1 {
+		t.Fatalf("Raft addresses %v: %v", addrs, err)
+	}
+	if err := a.AddVoter(b.realAddr()); err == nil {
+		t.Fatal("node of another cluster added as voter")
+	}
+}
+
+func TestRestartedMemberAdmitted(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a Serf/Raft cluster")
+	}
+	leader := newTestHaStore(t, "127.0.0.1", nil)
+	waitFor(t, "the leadership", leader.IsLeader)
+	var path string
+	follower := newTestHaStore(t, "127.0.0.1", func(opts *Options) { path = opts.Path }, leader.realAddr().String())
+	waitFor(t, "the cluster ID of the follower", func() bool {
+		return follower.clusterID() != "" && follower.clusterID() == leader.clusterID()
+	})
+
+	// removed from the Raft configuration by its graceful leave, it comes back with its Raft state
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the removal of the follower", func() bool {
+		addrs, err := leader.Addresses()
+		return err == nil && len(addrs) == 1
+	})
+	newTestHaStore(t, "127.0.0.1", func(opts *Options) { opts.Path = path }, leader.realAddr().String())
+	waitFor(t, "the restarted follower", func() bool {
+		addrs, err := leader.Addresses()
+		return err == nil && len(addrs) == 2
+	})
+	if rejected, _ := leader.RejectedJoins(); len(rejected) > 0 {
+		t.Fatalf("rejected joins %+v", rejected)
+	}
+}
+
+func TestBootstrapExpect(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a Serf/Raft cluster")
+	}
+	expect := func(opts *Options) { opts.BootstrapExpect = 3 }
+	first := newTestHaStore(t, "127.0.0.1", expect)
+	nodes := []*HaStore{
+		first,
+		newTestHaStore(t, "127.0.0.1", expect, first.realAddr().String()),
+		newTestHaStore(t, "127.0.0.1", expect, first.realAddr().String()),
+	}
+	waitFor(t, "the cluster of 3 voters", func() bool {
+		for _, has := range nodes {
+			if addrs, err := has.Addresses(); err != nil || len(addrs) != 3 {
+				return false
+			}
+		}
+		return true
+	})
+	// a single node bootstrapped, the cluster ID it generated is learned by the others
+	waitFor(t, "the same cluster ID", func() bool {
+		id := first.clusterID()
+		return id != "" && nodes[1].clusterID() == id && nodes[2].clusterID() == id
+	})
+}
+
+func TestLeaderShutdown(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a Serf/Raft cluster")
+	}
+	leader := newTestHaStore(t, "127.0.0.1", nil)
+	waitFor(t, "the leadership", leader.IsLeader)
+	follower := newTestHaStore(t, "127.0.0.1", nil, leader.realAddr().String())
+	waitFor(t, "the follower as voter", func() bool {
+		addrs, err := leader.Addresses()
+		return err == nil && len(addrs) == 2
+	})
+
+	// demoted, then removed by the new leader once it left the Serf cluster
+	if err := leader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the leadership of the follower alone", func() bool {
+		addrs, err := follower.Addresses()
+		return follower.IsLeader() && err == nil && len(addrs) == 1
+	})
+
+	// the graceful steps are skipped, not run concurrently with the stop
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := follower.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,272 @@
+package habolt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// reservedPrefix starts the name of our internal buckets, it can't start a bucket name
+	reservedPrefix = "_habolt_"
+	// metaBucketPrefix is prepended to a bucket name to get its metadata bucket
+	metaBucketPrefix = reservedPrefix + "meta_"
+	// expireBucketPrefix is prepended to a bucket name to get its expiry index,
+	// where the keys with a TTL are sorted by expiration time (see expireKey)
+	expireBucketPrefix = reservedPrefix + "exp_"
+)
+
+var (
+	// raftBucket stores the index of the last Raft log applied to the BoltDB
+	raftBucket      = []byte(reservedPrefix + "raft")
+	appliedIndexKey = []byte("applied")
+)
+
+// keyMeta is stored in the metadata bucket, alongside each value
+type keyMeta struct {
+	// Revision of the last modification, taken from the metadata bucket sequence
+	// so it is unique and increasing in the whole bucket
+	Revision uint64 `json:"rev"`
+
+	// ExpireAt is the unix time in nanoseconds when the key expires, 0 if it never expires
+	ExpireAt int64 `json:"exp,omitempty"`
+}
+
+func (m *keyMeta) expired(now int64) bool {
+	return m.ExpireAt != 0 && m.ExpireAt <= now
+}
+
+// expired returns true if "key" has expired at "now", it is only used to hide keys on reads:
+// the FSM never looks at the clock, expired keys are deleted by replicated commands
+func (s *StaticStore) expired(tx *bolt.Tx, key string, now int64) bool {
+	meta, err := s.meta(tx, key)
+	return err == nil && meta.expired(now)
+}
+
+// metasBucket return the metadata bucket, it is created for stores opened before versioning
+func (s *StaticStore) metasBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	if metas := tx.Bucket(s.metaBucket); metas != nil {
+		return metas, nil
+	}
+	return tx.CreateBucket(s.metaBucket)
+}
+
+// meta return the metadata of "key", an unknown key has a zero revision
+func (s *StaticStore) meta(tx *bolt.Tx, key string) (*keyMeta, error) {
+	meta := &keyMeta{}
+	metas := tx.Bucket(s.metaBucket)
+	if metas == nil {
+		// read-only store opened before versioning
+		return meta, nil
+	}
+	raw := metas.Get([]byte(key))
+	if raw == nil {
+		return meta, nil
+	}
+	if err := json.Unmarshal(raw, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// checkVersion returns ErrVersionMismatch if "key" is not at "version",
+// a key expired at "now" is at version 0 like a missing key (now = 0 ignores the TTLs)
+func (s *StaticStore) checkVersion(tx *bolt.Tx, key string, version uint64, now int64) error {
+	meta, err := s.meta(tx, key)
+	if err != nil {
+		return err
+	}
+	revision := meta.Revision
+	if meta.expired(now) {
+		revision = 0
+	}
+	if revision != version {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// expireKey return the key of "key" in the expiry index: its expiration time
+// (8 bytes big endian, so the index is sorted by time) followed by the key
+func expireKey(expireAt int64, key string) []byte {
+	raw := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(raw, uint64(expireAt))
+	return append(raw, key...)
+}
+
+// indexExpire moves "key" in the expiry index from the time "oldAt" to "newAt" (0 = no TTL)
+func (s *StaticStore) indexExpire(tx *bolt.Tx, key string, oldAt, newAt int64) error {
+	if oldAt == newAt {
+		return nil
+	}
+	index, err := tx.CreateBucketIfNotExists(s.expireBucket)
+	if err != nil {
+		return err
+	}
+	if oldAt != 0 {
+		if err := index.Delete(expireKey(oldAt, key)); err != nil {
+			return err
+		}
+	}
+	if newAt != 0 {
+		return index.Put(expireKey(newAt, key), nil)
+	}
+	return nil
+}
+
+// put stores the raw "val" of "key" with a new revision and its expiration time
+func (s *StaticStore) put(tx *bolt.Tx, key string, val []byte, expireAt int64) (uint64, error) {
+	bucket, err := s.dataBucket(tx)
+	if err != nil {
+		return 0, err
+	}
+	metas, err := s.metasBucket(tx)
+	if err != nil {
+		return 0, err
+	}
+	old, err := s.meta(tx, key)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.indexExpire(tx, key, old.ExpireAt, expireAt); err != nil {
+		return 0, err
+	}
+	rev, err := metas.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	raw, err := json.Marshal(&keyMeta{Revision: rev, ExpireAt: expireAt})
+	if err != nil {
+		return 0, err
+	}
+	if err := metas.Put([]byte(key), raw); err != nil {
+		return 0, err
+	}
+	if err := bucket.Put([]byte(key), val); err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// remove deletes "key" and its metadata, the deletion consumes a revision too
+func (s *StaticStore) remove(tx *bolt.Tx, key string) (uint64, error) {
+	bucket, err := s.dataBucket(tx)
+	if err != nil {
+		return 0, err
+	}
+	metas, err := s.metasBucket(tx)
+	if err != nil {
+		return 0, err
+	}
+	old, err := s.meta(tx, key)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.indexExpire(tx, key, old.ExpireAt, 0); err != nil {
+		return 0, err
+	}
+	rev, err := metas.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	if err := metas.Delete([]byte(key)); err != nil {
+		return 0, err
+	}
+	if err := bucket.Delete([]byte(key)); err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// listExpired return the revision of every key expired at "now", only the
+// due part of the expiry index is read
+func (s *StaticStore) listExpired(now int64) (map[string]uint64, error) {
+	tx, err := s.conn.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res := make(map[string]uint64)
+	index := tx.Bucket(s.expireBucket)
+	if index == nil {
+		return res, nil
+	}
+	curs := index.Cursor()
+	for raw, _ := curs.First(); len(raw) >= 8; raw, _ = curs.Next() {
+		if int64(binary.BigEndian.Uint64(raw)) > now {
+			break
+		}
+		key := string(raw[8:])
+		meta, err := s.meta(tx, key)
+		if err != nil {
+			return nil, err
+		}
+		res[key] = meta.Revision
+	}
+	return res, nil
+}
+
+// deleteExpired deletes in a single transaction the keys of "ops" still at their revision
+// (listed by listExpired), the keys modified since then are kept
+func (s *StaticStore) deleteExpired(ops []txnOp) error {
+	tx, err := s.conn.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	events := make([]WatchEvent, 0, len(ops))
+	for _, op := range ops {
+		if err := s.checkVersion(tx, op.Key, op.Version, 0); err == ErrVersionMismatch {
+			continue
+		} else if err != nil {
+			return err
+		}
+		rev, err := s.remove(tx, op.Key)
+		if err != nil {
+			return err
+		}
+		events = append(events, s.event(EventDelete, op.Key, nil, rev))
+	}
+	return s.commit(tx, events...)
+}
+
+// atIndex return a copy of our store recording the Raft log "index" with its changes,
+// in the same transaction, so the FSM knows the logs already applied after a restart
+func (s *StaticStore) atIndex(index uint64) *StaticStore {
+	store := *s
+	store.index = index
+	return &store
+}
+
+// putAppliedIndex records "index" as the last Raft log applied by the transaction
+func putAppliedIndex(tx *bolt.Tx, index uint64) error {
+	bucket, err := tx.CreateBucketIfNotExists(raftBucket)
+	if err != nil {
+		return err
+	}
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, index)
+	return bucket.Put(appliedIndexKey, raw)
+}
+
+// appliedIndex return the index of the last Raft log applied to our BoltDB, 0 if none
+func (s *StaticStore) appliedIndex() (uint64, error) {
+	tx, err := s.conn.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	bucket := tx.Bucket(raftBucket)
+	if bucket == nil {
+		return 0, nil
+	}
+	raw := bucket.Get(appliedIndexKey)
+	if len(raw) != 8 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(raw), nil
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"path/filepath"
 	"reflect"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/hashicorp/go-sockaddr"
@@ -23,6 +24,15 @@ type StaticStore struct {
 	// Bucket to use
 	bucket []byte
 
+	// Default bucket of the BoltDB (Options.Bucket)
+	rootBucket []byte
+
+	// Bucket where the metadata (revision) of each key are stored
+	metaBucket []byte
+
+	// Bucket where the keys with a TTL are indexed by expiration time
+	expireBucket []byte
+
 	// Log writer
 	output io.Writer
 
@@ -31,6 +41,12 @@ type StaticStore struct {
 
 	// Bind IP
 	bindIP  *HaAddress
+
+	// Watchers of our changes, shared by every bucket
+	watch *watchList
+
+	// Raft log index recorded with our changes, 0 when they are not applied by our FSM
+	index uint64
 }
 
 // NewStaticStore uses the supplied options to open the BoltDB and prepare it for use as a raft backend.
@@ -47,11 +63,15 @@ func NewStaticStore(options *Options) (*StaticStore, error) {
 
 	// Create the new StaticStore
 	StaticStore := &StaticStore{
-		conn:   handle,
-		path:   options.Path,
-		bucket: []byte(options.Bucket),
-		output: options.LogOutput,
-		logger: options.Logger,
+		conn:         handle,
+		path:         options.Path,
+		bucket:       []byte(options.Bucket),
+		rootBucket:   []byte(options.Bucket),
+		metaBucket:   []byte(metaBucketPrefix + options.Bucket),
+		expireBucket: []byte(expireBucketPrefix + options.Bucket),
+		output:       options.LogOutput,
+		logger:       options.Logger,
+		watch:        newWatchList(),
 	}
 
 	// If the StaticStore was opened read-only, don't try and create buckets
@@ -76,12 +96,19 @@ func (s *StaticStore) initialize() error {
 	if _, err := tx.CreateBucketIfNotExists(s.bucket); err != nil {
 		return err
 	}
+	if _, err := tx.CreateBucketIfNotExists(s.metaBucket); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucketIfNotExists(s.expireBucket); err != nil {
+		return err
+	}
 
 	return tx.Commit()
 }
 
-// Close is used to gracefully close the DB connection.
+// Close is used to gracefully close the DB connection (for every bucket).
 func (s *StaticStore) Close() error {
+	s.unwatchAll()
 	return s.conn.Close()
 }
 
@@ -113,18 +140,30 @@ func found(str string, patterns []string) bool {
 	return false
 }
 
-// ListRaw retrive all "key"/"value" with any modification
+// ListRaw retrive all "key"/"value" with any modification (expired keys excluded)
 func (s *StaticStore) ListRaw() (map[string]string, error) {
+	return s.listRaw(false)
+}
+
+// listRaw retrive all "key"/"value", including the expired keys not deleted yet if "withExpired"
+func (s *StaticStore) listRaw(withExpired bool) (map[string]string, error) {
 	tx, err := s.conn.Begin(false)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
+	bucket, err := s.dataBucket(tx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixNano()
 	res := make(map[string]string)
-	curs := tx.Bucket(s.bucket).Cursor()
+	curs := bucket.Cursor()
 	for key, val := curs.First(); key != nil; key, val = curs.Next() {
-		res[string(key)] = string(val)
+		if withExpired || !s.expired(tx, string(key), now) {
+			res[string(key)] = string(val)
+		}
 	}
 
 	return res, nil
@@ -145,9 +184,14 @@ func (s *StaticStore) List(values interface{}, patterns ...string) error {
 	}
 	defer tx.Rollback()
 
-	curs := tx.Bucket(s.bucket).Cursor()
+	bucket, err := s.dataBucket(tx)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	curs := bucket.Cursor()
 	for key, val := curs.First(); key != nil; key, val = curs.Next() {
-		if found(string(key), patterns) {
+		if found(string(key), patterns) && !s.expired(tx, string(key), now) {
 			value := reflect.New(slice.Type().Elem())
 			if err := json.Unmarshal(val, value.Interface()); err != nil {
 				return err
@@ -171,17 +215,64 @@ func (s *StaticStore) Get(key string, value interface{}) error {
 	}
 	defer tx.Rollback()
 
-	bucket := tx.Bucket(s.bucket)
+	bucket, err := s.dataBucket(tx)
+	if err != nil {
+		return err
+	}
 	val := bucket.Get([]byte(key))
 
-	if val == nil {
+	if val == nil || s.expired(tx, key, time.Now().UnixNano()) {
 		return ErrKeyNotFound
 	}
 	return json.Unmarshal(val, value)
 }
 
+// GetWithVersion works like Get and also returns the current version (revision) of the "key"
+func (s *StaticStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	vtype := reflect.TypeOf(value)
+	if vtype.Kind() != reflect.Ptr {
+		return 0, errors.New("Not a Pointer")
+	}
+	tx, err := s.conn.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	bucket, err := s.dataBucket(tx)
+	if err != nil {
+		return 0, err
+	}
+	val := bucket.Get([]byte(key))
+	if val == nil {
+		return 0, ErrKeyNotFound
+	}
+	meta, err := s.meta(tx, key)
+	if err != nil {
+		return 0, err
+	}
+	if meta.expired(time.Now().UnixNano()) {
+		return 0, ErrKeyNotFound
+	}
+	return meta.Revision, json.Unmarshal(val, value)
+}
+
 // Set "json.Mashal" the "value" and store it in BoltDB with the specified "key"
 func (s *StaticStore) Set(key string, value interface{}) error {
+	return s.setExpire(key, value, 0)
+}
+
+// SetWithTTL works like Set, but the "key" expires after "ttl" (ErrTTL if not positive).
+// An expired key is hidden from reads until it is deleted.
+func (s *StaticStore) SetWithTTL(key string, value interface{}, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrTTL
+	}
+	return s.setExpire(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// setExpire stores the "key" which expires at the "expireAt" unix time in nanoseconds (0 = never)
+func (s *StaticStore) setExpire(key string, value interface{}, expireAt int64) error {
 	val, err := json.Marshal(value)
 	if err != nil {
 		return err
@@ -192,12 +283,42 @@ func (s *StaticStore) Set(key string, value interface{}) error {
 	}
 	defer tx.Rollback()
 
-	bucket := tx.Bucket(s.bucket)
-	if err := bucket.Put([]byte(key), val); err != nil {
+	rev, err := s.put(tx, key, val, expireAt)
+	if err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	return s.commit(tx, s.event(EventSet, key, val, rev))
+}
+
+// CompareAndSet works like Set only if the current version of "key" is "version",
+// otherwise ErrVersionMismatch is returned. Version 0 means the key must not exist.
+// Like Set, the TTL of the key is removed (see SetWithTTL). An expired key is at version 0.
+func (s *StaticStore) CompareAndSet(key string, version uint64, value interface{}) error {
+	return s.compareAndSet(key, version, value, time.Now().UnixNano())
+}
+
+// compareAndSet works like CompareAndSet, the keys expired at "now" are at version 0
+func (s *StaticStore) compareAndSet(key string, version uint64, value interface{}, now int64) error {
+	val, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	tx, err := s.conn.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.checkVersion(tx, key, version, now); err != nil {
+		return err
+	}
+	rev, err := s.put(tx, key, val, 0)
+	if err != nil {
+		return err
+	}
+
+	return s.commit(tx, s.event(EventSet, key, val, rev))
 }
 
 // Delete removes the "key" in BoltDB
@@ -208,11 +329,35 @@ func (s *StaticStore) Delete(key string) error {
 	}
 	defer tx.Rollback()
 
-	bucket := tx.Bucket(s.bucket)
-	if err := bucket.Delete([]byte(key)); err != nil {
+	rev, err := s.remove(tx, key)
+	if err != nil {
 		return err
 	}
-	return tx.Commit()
+	return s.commit(tx, s.event(EventDelete, key, nil, rev))
+}
+
+// CompareAndDelete works like Delete only if the current version of "key" is "version",
+// otherwise ErrVersionMismatch is returned. An expired key is at version 0.
+func (s *StaticStore) CompareAndDelete(key string, version uint64) error {
+	return s.compareAndDelete(key, version, time.Now().UnixNano())
+}
+
+// compareAndDelete works like CompareAndDelete, the keys expired at "now" are at version 0
+func (s *StaticStore) compareAndDelete(key string, version uint64, now int64) error {
+	tx, err := s.conn.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.checkVersion(tx, key, version, now); err != nil {
+		return err
+	}
+	rev, err := s.remove(tx, key)
+	if err != nil {
+		return err
+	}
+	return s.commit(tx, s.event(EventDelete, key, nil, rev))
 }
 
 // Addresses return slice which contains a signe entry : "GetPrivateIP" from go-sockaddr
@@ -0,0 +1,100 @@
+package habolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompareExpiredKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "habolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStaticStore(&Options{Path: filepath.Join(dir, "test.db"), LogOutput: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, key := range []string{"set", "stale", "del"} {
+		if err := s.SetWithTTL(key, 1, 50*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var value int
+	stale, err := s.GetWithVersion("stale", &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	del, err := s.GetWithVersion("del", &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if err := s.CompareAndSet("stale", stale, 2); err != ErrVersionMismatch {
+		t.Fatalf("expired key set with its last version: %v", err)
+	}
+	if err := s.Get("stale", &value); err != ErrKeyNotFound {
+		t.Fatalf("expired key brought back: %v", err)
+	}
+	if err := s.CompareAndDelete("del", del); err != ErrVersionMismatch {
+		t.Fatalf("expired key deleted with its last version: %v", err)
+	}
+	if err := s.CompareAndDelete("del", 0); err != nil {
+		t.Fatalf("expired key not at version 0: %v", err)
+	}
+	if err := s.CompareAndSet("set", 0, 2); err != nil {
+		t.Fatalf("expired key not at version 0: %v", err)
+	}
+	if err := s.Get("set", &value); err != nil || value != 2 {
+		t.Fatalf("set = %d: %v", value, err)
+	}
+}
+
+func TestExpireIndex(t *testing.T) {
+	f := newTestFsm(t, CodecNone)
+	s := f.store
+	for _, key := range []string{"due", "updated", "deleted"} {
+		if err := s.SetWithTTL(key, 1, time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetWithTTL("later", 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetWithTTL("never", 1, 0); err != ErrTTL {
+		t.Fatalf("TTL 0 accepted: %v", err)
+	}
+	if err := s.Set("updated", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	var value int
+	later, err := s.GetWithVersion("later", &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := s.listExpired(time.Now().UnixNano())
+	if err != nil || len(expired) != 1 || expired["due"] == 0 {
+		t.Fatalf("expired keys %v: %v", expired, err)
+	}
+
+	// the index is rebuilt by a restore
+	dst := newTestFsm(t, CodecNone)
+	if err := restore(dst, snapshot(t, f)); err != nil {
+		t.Fatal(err)
+	}
+	expired, err = dst.store.listExpired(time.Now().Add(2 * time.Hour).UnixNano())
+	if err != nil || len(expired) != 2 || expired["due"] == 0 || expired["later"] != later {
+		t.Fatalf("expired keys %v after the restore: %v", expired, err)
+	}
+}
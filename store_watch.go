@@ -0,0 +1,181 @@
+package habolt
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// watchBuffer is the number of events a watcher could miss reading before events are dropped
+const watchBuffer = 64
+
+// EventType defines the kind of change sent to watchers
+type EventType int
+
+const (
+	// EventSet when a key is created or updated
+	EventSet EventType = iota
+	// EventDelete when a key is deleted (or expired)
+	EventDelete
+	// EventReset when the whole store is replaced by a Raft snapshot (i.e. on a lagging node),
+	// every watcher receives it without Key: the changes in between are not sent, read the keys again
+	EventReset
+)
+
+// WatchEvent describes a change of a key
+type WatchEvent struct {
+	Type   EventType
+	Bucket string
+	Key    string
+	// Value is the new JSON value, nil on EventDelete
+	Value json.RawMessage
+	// Revision of the change (see GetWithVersion)
+	Revision uint64
+}
+
+// Decode "json.Unmarshal" the new value of the key to "value"
+func (evt *WatchEvent) Decode(value interface{}) error {
+	return json.Unmarshal(evt.Value, value)
+}
+
+type watcher struct {
+	bucket   string
+	patterns []string
+	events   chan WatchEvent
+}
+
+// watchList is shared by every bucket of a StaticStore
+type watchList struct {
+	mutex    sync.Mutex
+	watchers map[*watcher]struct{}
+	// closed once the StaticStore is closed
+	closed chan struct{}
+}
+
+func newWatchList() *watchList {
+	return &watchList{
+		watchers: make(map[*watcher]struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Watch return a channel receiving every change of the bucket keys matching the wildcard patterns
+// (i.e. "prefix_*", every key without pattern). The channel is closed once "ctx" is done or the Store closed.
+// Events are dropped (and logged) when the channel is full, so read it continuously (see EventReset).
+func (s *StaticStore) Watch(ctx context.Context, patterns ...string) <-chan WatchEvent {
+	w := &watcher{
+		bucket:   string(s.bucket),
+		patterns: patterns,
+		events:   make(chan WatchEvent, watchBuffer),
+	}
+	s.watch.mutex.Lock()
+	defer s.watch.mutex.Unlock()
+	select {
+	case <-s.watch.closed:
+		close(w.events)
+		return w.events
+	default:
+	}
+	s.watch.watchers[w] = struct{}{}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.unwatch(w)
+		case <-s.watch.closed:
+		}
+	}()
+	return w.events
+}
+
+func (s *StaticStore) unwatch(w *watcher) {
+	s.watch.mutex.Lock()
+	defer s.watch.mutex.Unlock()
+	if _, ok := s.watch.watchers[w]; ok {
+		delete(s.watch.watchers, w)
+		close(w.events)
+	}
+}
+
+func (s *StaticStore) unwatchAll() {
+	s.watch.mutex.Lock()
+	defer s.watch.mutex.Unlock()
+	select {
+	case <-s.watch.closed:
+	default:
+		close(s.watch.closed)
+	}
+	for w := range s.watch.watchers {
+		delete(s.watch.watchers, w)
+		close(w.events)
+	}
+}
+
+// event create a WatchEvent on our bucket
+func (s *StaticStore) event(kind EventType, key string, val []byte, rev uint64) WatchEvent {
+	return WatchEvent{
+		Type:     kind,
+		Bucket:   string(s.bucket),
+		Key:      key,
+		Value:    val,
+		Revision: rev,
+	}
+}
+
+// commit the transaction, with our Raft log index if any (see atIndex),
+// then send the events to the interested watchers
+func (s *StaticStore) commit(tx *bolt.Tx, events ...WatchEvent) error {
+	if s.index > 0 {
+		if err := putAppliedIndex(tx, s.index); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.notify(events...)
+	return nil
+}
+
+func (s *StaticStore) notify(events ...WatchEvent) {
+	s.watch.mutex.Lock()
+	defer s.watch.mutex.Unlock()
+	for _, evt := range events {
+		for w := range s.watch.watchers {
+			if w.bucket != evt.Bucket || !found(evt.Key, w.patterns) {
+				continue
+			}
+			select {
+			case w.events <- evt:
+			default:
+				s.logger.Printf("[WARN] Watch: Event dropped for key %s (revision %d), watcher is too slow", evt.Key, evt.Revision)
+			}
+		}
+	}
+}
+
+// notifyReset sends an EventReset to every watcher, the oldest event of a full channel is
+// dropped for it: the watcher has to read the keys again anyway
+func (s *StaticStore) notifyReset() {
+	s.watch.mutex.Lock()
+	defer s.watch.mutex.Unlock()
+	for w := range s.watch.watchers {
+		evt := WatchEvent{Type: EventReset, Bucket: w.bucket}
+		select {
+		case w.events <- evt:
+			continue
+		default:
+		}
+		select {
+		case <-w.events:
+		default:
+		}
+		select {
+		case w.events <- evt:
+		default:
+			s.logger.Printf("[WARN] Watch: Reset event dropped for bucket %s, watcher is too slow", w.bucket)
+		}
+	}
+}
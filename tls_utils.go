@@ -0,0 +1,83 @@
+package habolt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// TLSConfig secures the Raft port of an HaStore, i.e. Raft replication and our RPC between nodes
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM certificate and key of this node, used as server
+	// and as client (mutual authentication)
+	CertFile string
+	KeyFile  string
+
+	// CAFile is the PEM bundle of the CAs which sign the certificates of the nodes, required
+	// to verify the incoming connections (the system CAs would accept any public certificate).
+	// With SkipVerifyIncoming, the system CAs are used if empty.
+	CAFile string
+
+	// ServerName is the name the certificates of the other nodes must be valid for,
+	// if empty their certificate must be valid for the address we dial (IP SAN)
+	ServerName string
+
+	// SkipVerifyIncoming accepts the TLS clients without certificate, i.e. while the nodes of an
+	// existing cluster get theirs, a client certificate is then only verified if the node sends one.
+	// By default every incoming TLS connection needs a certificate signed by CAFile.
+	SkipVerifyIncoming bool
+
+	// AllowPlaintext accepts the plaintext connections too, i.e. while the nodes of
+	// an existing cluster are migrated to TLS. They are rejected by default.
+	AllowPlaintext bool
+}
+
+var (
+	// ErrTLSKeyPair when only one of TLSConfig.CertFile and TLSConfig.KeyFile is set
+	ErrTLSKeyPair = errors.New("TLS needs both a certificate and a key")
+	// ErrTLSNoCA when the incoming connections are verified without TLSConfig.CAFile
+	ErrTLSNoCA = errors.New("TLS needs a CA file to verify the client certificates")
+)
+
+// load return the TLS configurations for our listener and for the connections we dial
+func (c *TLSConfig) load() (server *tls.Config, client *tls.Config, err error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, nil, ErrTLSKeyPair
+	}
+	if c.CAFile == "" && !c.SkipVerifyIncoming {
+		return nil, nil, ErrTLSNoCA
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var pool *x509.CertPool
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, errors.New("No certificate found in " + c.CAFile)
+		}
+	}
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.SkipVerifyIncoming {
+		server.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   c.ServerName,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return server, client, nil
+}
@@ -0,0 +1,148 @@
+package habolt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCerts writes in "dir" a CA and a certificate it signs for 127.0.0.1, shared by every node
+func writeTestCerts(t *testing.T, dir string) *TLSConfig {
+	writePEM := func(name, kind string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "habolt CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "habolt node"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	nodeDER, err := x509.CreateCertificate(rand.Reader, node, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &TLSConfig{
+		CAFile:   writePEM("ca.pem", "CERTIFICATE", caDER),
+		CertFile: writePEM("node.pem", "CERTIFICATE", nodeDER),
+		KeyFile:  writePEM("node-key.pem", "EC PRIVATE KEY", keyDER),
+	}
+}
+
+func TestTLSConfigLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "habolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := writeTestCerts(t, dir)
+
+	if _, _, err := (&TLSConfig{CertFile: config.CertFile, CAFile: config.CAFile}).load(); err != ErrTLSKeyPair {
+		t.Fatalf("certificate without key: %v", err)
+	}
+	if _, _, err := (&TLSConfig{CertFile: config.CertFile, KeyFile: config.KeyFile}).load(); err != ErrTLSNoCA {
+		t.Fatalf("incoming connections verified without CA: %v", err)
+	}
+	server, _, err := (&TLSConfig{CertFile: config.CertFile, KeyFile: config.KeyFile, SkipVerifyIncoming: true}).load()
+	if err != nil || server.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatalf("SkipVerifyIncoming: %v", err)
+	}
+	server, client, err := config.load()
+	if err != nil || server.ClientAuth != tls.RequireAndVerifyClientCert || client.RootCAs == nil {
+		t.Fatalf("default configuration: %v", err)
+	}
+}
+
+func TestTLSCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a Serf/Raft cluster")
+	}
+	dir, err := ioutil.TempDir("", "habolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := writeTestCerts(t, dir)
+	secure := func(opts *Options) { opts.TLS = config }
+
+	leader := newTestHaStore(t, "127.0.0.1", secure)
+	waitFor(t, "the leadership", leader.IsLeader)
+	follower := newTestHaStore(t, "127.0.0.1", secure, leader.realAddr().String())
+	waitFor(t, "the follower as voter", func() bool {
+		addrs, err := leader.Addresses()
+		return err == nil && len(addrs) == 2
+	})
+	waitFor(t, "the leader seen by the follower", func() bool {
+		_, err := follower.Leader()
+		return err == nil
+	})
+	// replicated by Raft and forwarded by our RPC over TLS
+	if _, err := follower.SetSync("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if err := leader.GetConsistent(ReadLinearizable, "key", &value); err != nil || value != "value" {
+		t.Fatalf("key = %q on the leader: %v", value, err)
+	}
+
+	_, client, err := config.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous := &tls.Config{RootCAs: client.RootCAs, MinVersion: tls.VersionTLS12}
+	for name, tlsConfig := range map[string]*tls.Config{"plaintext": nil, "no client certificate": anonymous} {
+		conn, err := dialRPC(leader.raftAdvertise.String(), rpcHaStore, time.Second, tlsConfig)
+		if err != nil {
+			continue
+		}
+		var raw []byte
+		err = rpc.NewClient(conn).Call(rpcName+".Stats", "test", &raw)
+		conn.Close()
+		if err == nil {
+			t.Errorf("%s RPC accepted", name)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package habolt
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	txnSet        = "set"
+	txnDelete     = "del"
+	txnIfVersion  = "version"
+	txnIfExists   = "exists"
+	txnIfNotExist = "missing"
+)
+
+// Txn groups operations and guards applied atomically by Commit: all of them or none.
+// Operations are applied in order on the bucket of the Store committing the Txn.
+type Txn struct {
+	ops []txnOp
+	err error
+}
+
+type txnOp struct {
+	Op      string          `json:"op"`
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Version uint64          `json:"version,omitempty"`
+}
+
+// TxnResult is the result of one operation of a committed Txn
+type TxnResult struct {
+	Key string
+	// Revision is the new revision of the key for Set/Delete, its current revision for guards
+	Revision uint64
+}
+
+// TxnError is returned when a Txn is rejected, none of its operations has been applied
+type TxnError struct {
+	// Index of the operation which failed
+	Index int
+	Key   string
+	Err   error
+}
+
+func (e *TxnError) Error() string {
+	return fmt.Sprintf("Txn rejected by operation %d on key %s: %v", e.Index, e.Key, e.Err)
+}
+
+// txnResponse is returned by our FSM, a rejected Txn is not an FSM error
+type txnResponse struct {
+	Revisions []uint64 `json:"revisions,omitempty"`
+	Failed    int      `json:"failed"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// NewTxn create an empty transaction
+func NewTxn() *Txn {
+	return &Txn{}
+}
+
+// Set "json.Mashal" the "value" and store it with the specified "key"
+func (t *Txn) Set(key string, value interface{}) *Txn {
+	val, err := json.Marshal(value)
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	t.ops = append(t.ops, txnOp{Op: txnSet, Key: key, Value: val})
+	return t
+}
+
+// Delete removes the "key"
+func (t *Txn) Delete(key string) *Txn {
+	t.ops = append(t.ops, txnOp{Op: txnDelete, Key: key})
+	return t
+}
+
+// IfVersion rejects the Txn if "key" is not at "version" (0 if it does not exist or expired)
+func (t *Txn) IfVersion(key string, version uint64) *Txn {
+	t.ops = append(t.ops, txnOp{Op: txnIfVersion, Key: key, Version: version})
+	return t
+}
+
+// IfExists rejects the Txn if "key" does not exist, an expired key does not exist
+func (t *Txn) IfExists(key string) *Txn {
+	t.ops = append(t.ops, txnOp{Op: txnIfExists, Key: key})
+	return t
+}
+
+// IfNotExists rejects the Txn if "key" exists and has not expired
+func (t *Txn) IfNotExists(key string) *Txn {
+	t.ops = append(t.ops, txnOp{Op: txnIfNotExist, Key: key})
+	return t
+}
+
+// results return the result of each operation, or a *TxnError if the Txn was rejected
+func (r *txnResponse) results(ops []txnOp) ([]TxnResult, error) {
+	if r.Failed >= 0 {
+		key := ""
+		if r.Failed < len(ops) {
+			key = ops[r.Failed].Key
+		}
+		return nil, &TxnError{Index: r.Failed, Key: key, Err: knownError(r.Error)}
+	}
+	res := make([]TxnResult, len(ops))
+	for i, op := range ops {
+		res[i].Key = op.Key
+		if i < len(r.Revisions) {
+			res[i].Revision = r.Revisions[i]
+		}
+	}
+	return res, nil
+}
+
+// Commit applies every operation of the transaction atomically in a single BoltDB transaction.
+// A rejected transaction returns a *TxnError and nothing is applied.
+func (s *StaticStore) Commit(txn *Txn) ([]TxnResult, error) {
+	if txn.err != nil {
+		return nil, txn.err
+	}
+	resp, err := s.commitTxn(txn.ops, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	return resp.results(txn.ops)
+}
+
+// commitTxn applies the operations, a failing operation rejects the whole Txn
+// in the response, only the BoltDB failures are returned as errors.
+// The guards see the keys expired at "now" as missing, like reads.
+func (s *StaticStore) commitTxn(ops []txnOp, now int64) (*txnResponse, error) {
+	tx, err := s.conn.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	resp := &txnResponse{Failed: -1}
+	events := make([]WatchEvent, 0, len(ops))
+	for i, op := range ops {
+		rev, evt, err := s.txnApply(tx, op, now)
+		if err != nil {
+			return &txnResponse{Failed: i, Error: err.Error()}, nil
+		}
+		resp.Revisions = append(resp.Revisions, rev)
+		if evt != nil {
+			events = append(events, *evt)
+		}
+	}
+
+	if err := s.commit(tx, events...); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s *StaticStore) txnApply(tx *bolt.Tx, op txnOp, now int64) (uint64, *WatchEvent, error) {
+	bucket, err := s.dataBucket(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch op.Op {
+	case txnSet:
+		rev, err := s.put(tx, op.Key, op.Value, 0)
+		if err != nil {
+			return 0, nil, err
+		}
+		evt := s.event(EventSet, op.Key, op.Value, rev)
+		return rev, &evt, nil
+	case txnDelete:
+		rev, err := s.remove(tx, op.Key)
+		if err != nil {
+			return 0, nil, err
+		}
+		evt := s.event(EventDelete, op.Key, nil, rev)
+		return rev, &evt, nil
+	}
+
+	meta, err := s.meta(tx, op.Key)
+	if err != nil {
+		return 0, nil, err
+	}
+	revision := meta.Revision
+	exists := bucket.Get([]byte(op.Key)) != nil && !meta.expired(now)
+	if !exists {
+		revision = 0
+	}
+	switch op.Op {
+	case txnIfVersion:
+		if revision != op.Version {
+			return 0, nil, ErrVersionMismatch
+		}
+	case txnIfExists:
+		if !exists {
+			return 0, nil, ErrKeyNotFound
+		}
+	case txnIfNotExist:
+		if exists {
+			return 0, nil, ErrKeyExists
+		}
+	default:
+		return 0, nil, fmt.Errorf("Unrecognized Txn op %s", op.Op)
+	}
+	return revision, nil, nil
+}
@@ -0,0 +1,60 @@
+package habolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTxnGuardsExpiredKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "habolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStaticStore(&Options{Path: filepath.Join(dir, "test.db"), LogOutput: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.SetWithTTL("expired", 1, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetWithTTL("alive", 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	var value int
+	if err := s.Get("expired", &value); err != ErrKeyNotFound {
+		t.Fatalf("expired key read: %v", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		txn  *Txn
+		ok   bool
+	}{
+		{"exists expired", NewTxn().IfExists("expired"), false},
+		{"not exists expired", NewTxn().IfNotExists("expired"), true},
+		{"version 0 expired", NewTxn().IfVersion("expired", 0), true},
+		{"exists alive", NewTxn().IfExists("alive"), true},
+		{"not exists alive", NewTxn().IfNotExists("alive"), false},
+		{"version 0 alive", NewTxn().IfVersion("alive", 0), false},
+	} {
+		if _, err := s.Commit(test.txn); (err == nil) != test.ok {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+
+	res, err := s.Commit(NewTxn().IfNotExists("expired").Set("expired", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := s.GetWithVersion("expired", &value)
+	if err != nil || value != 2 || version != res[1].Revision {
+		t.Fatalf("expired = %d version %d: %v", value, version, err)
+	}
+}